@@ -0,0 +1,46 @@
+package client
+
+import (
+	"errors"
+	"strconv"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+// Errors a CloseError unwraps to, one per protocol.CloseCode, so callers can
+// use errors.Is without looking at codes.
+var (
+	ErrDialRefused     = errors.New("target refused the connection")
+	ErrDNSFailure      = errors.New("target couldn't be resolved")
+	ErrHostUnreachable = errors.New("target is unreachable")
+	ErrPolicyDenied    = errors.New("denied by server policy")
+	ErrQuotaExceeded   = errors.New("traffic quota exceeded")
+	ErrEvicted         = errors.New("evicted by a newer connection")
+	ErrServerShutdown  = errors.New("server is shutting down")
+)
+
+var closeCodeErrors = map[protocol.CloseCode]error{
+	protocol.CloseDialRefused:     ErrDialRefused,
+	protocol.CloseDNSFailure:      ErrDNSFailure,
+	protocol.CloseHostUnreachable: ErrHostUnreachable,
+	protocol.ClosePolicyDenied:    ErrPolicyDenied,
+	protocol.CloseQuotaExceeded:   ErrQuotaExceeded,
+	protocol.CloseEvicted:         ErrEvicted,
+	protocol.CloseServerShutdown:  ErrServerShutdown,
+}
+
+// CloseError is returned when the server ends a tunnel with anything but a
+// normal closure, including refusing it on the handshake.
+type CloseError struct {
+	Code   ws.StatusCode
+	Reason string
+}
+
+func (err *CloseError) Error() string {
+	return "connection closed by server: " + strconv.Itoa(int(err.Code)) + " " + err.Reason
+}
+
+func (err *CloseError) Unwrap() error {
+	return closeCodeErrors[protocol.CloseCode(err.Code)]
+}
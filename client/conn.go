@@ -0,0 +1,146 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+var _ net.Conn = &Conn{}
+
+// ErrHalfCloseUnsupported is returned by CloseWrite when the server didn't
+// grant protocol.CapHalfClose, and always by mux streams. It wraps
+// errors.ErrUnsupported.
+var ErrHalfCloseUnsupported = fmt.Errorf("server doesn't support half-close: %w", errors.ErrUnsupported)
+
+type Conn struct {
+	ws         *wsConn
+	remoteAddr net.Addr
+	halfClose  bool
+
+	readMutex sync.Mutex
+	inMessage bool
+	inControl bool
+	readErr   error
+
+	writeClosed atomic.Bool
+}
+
+func newConn(wc *wsConn, remoteAddr net.Addr, pingInterval time.Duration, hs handshake) *Conn {
+	if pingInterval > 0 {
+		go wc.keepAlive(pingInterval)
+	}
+	return &Conn{
+		ws:         wc,
+		remoteAddr: remoteAddr,
+		halfClose:  hs.capabilities.Has(protocol.CapHalfClose),
+	}
+}
+
+func (conn *Conn) Read(p []byte) (int, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	if conn.readErr != nil {
+		return 0, conn.readErr
+	}
+
+	for {
+		if !conn.inMessage && !conn.inControl {
+			op, err := conn.ws.nextMessage()
+			if err != nil {
+				if !isTimeoutErr(err) {
+					conn.readErr = err
+				}
+				return 0, err
+			}
+			if op == ws.OpText && conn.halfClose {
+				conn.inControl = true
+			} else {
+				conn.inMessage = true
+			}
+		}
+		if conn.inControl {
+			message, err := conn.ws.readPayload()
+			if err != nil {
+				if !isTimeoutErr(err) {
+					conn.readErr = err
+				}
+				return 0, err
+			}
+			conn.inControl = false
+			if string(message) == protocol.HalfCloseMessage {
+				conn.readErr = io.EOF
+				return 0, io.EOF
+			}
+			continue
+		}
+
+		n, err := conn.ws.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			conn.inMessage = false
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (conn *Conn) Write(p []byte) (int, error) {
+	if conn.writeClosed.Load() {
+		return 0, net.ErrClosed
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if err := conn.ws.writeMessage(ws.OpBinary, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// CloseWrite tells the server no more data follows, so it shuts down the
+// writing side of the target connection. Reads keep working until the target
+// finishes too.
+func (conn *Conn) CloseWrite() error {
+	if !conn.halfClose {
+		return ErrHalfCloseUnsupported
+	}
+	if !conn.writeClosed.CompareAndSwap(false, true) {
+		return net.ErrClosed
+	}
+	return conn.ws.writeMessage(ws.OpText, []byte(protocol.HalfCloseMessage))
+}
+
+func (conn *Conn) Close() error {
+	return conn.ws.close(ws.StatusNormalClosure, "")
+}
+
+func (conn *Conn) LocalAddr() net.Addr {
+	return conn.ws.conn.LocalAddr()
+}
+
+func (conn *Conn) RemoteAddr() net.Addr {
+	return conn.remoteAddr
+}
+
+func (conn *Conn) SetDeadline(t time.Time) error {
+	return conn.ws.conn.SetDeadline(t)
+}
+
+func (conn *Conn) SetReadDeadline(t time.Time) error {
+	return conn.ws.conn.SetReadDeadline(t)
+}
+
+func (conn *Conn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.conn.SetWriteDeadline(t)
+}
@@ -0,0 +1,243 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+// AuthMethod selects how the token is sent to the server.
+type AuthMethod int
+
+const (
+	AuthQuery AuthMethod = iota
+	AuthHeader
+	AuthSubprotocol
+	AuthCookie
+)
+
+type Dialer struct {
+	URL              string
+	Auth             string
+	AuthMethod       AuthMethod
+	TLSConfig        *tls.Config
+	HandshakeTimeout time.Duration
+	PingInterval     time.Duration
+	NetDial          func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Multiplex makes DialContext open streams over one shared net=mux
+	// WebSocket instead of upgrading a new one per connection.
+	Multiplex bool
+
+	muxMutex sync.Mutex
+	mux      *MuxSession
+}
+
+func (dialer *Dialer) Dial(network, address string) (net.Conn, error) {
+	return dialer.DialContext(context.Background(), network, address)
+}
+
+func (dialer *Dialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("unsupported network: " + network)
+	}
+
+	if dialer.Multiplex {
+		session, err := dialer.sharedMux(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return session.DialContext(ctx, network, address)
+	}
+
+	wsConn, hs, err := dialer.dialWS(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newConn(wsConn, &Addr{Net: "tcp", Address: address}, dialer.PingInterval, hs), nil
+}
+
+// ListenPacket opens a net=udp tunnel. The server requires an endpoint on the
+// handshake, so address names the primary destination; WriteTo may still
+// target any address. Servers that support protocol.PacketFrame resolve
+// domain destinations themselves, older ones get addresses resolved locally.
+func (dialer *Dialer) ListenPacket(ctx context.Context, network, address string) (net.PacketConn, error) {
+	switch network {
+	case "udp", "udp4", "udp6":
+	default:
+		return nil, errors.New("unsupported network: " + network)
+	}
+
+	wsConn, hs, err := dialer.dialWS(ctx, "udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return newPacketConn(wsConn, dialer.PingInterval, hs), nil
+}
+
+func (dialer *Dialer) Cleanup(ctx context.Context) error {
+	cURL, err := dialer.endpointURL()
+	if err != nil {
+		return err
+	}
+	switch cURL.Scheme {
+	case "ws":
+		cURL.Scheme = "http"
+	case "wss":
+		cURL.Scheme = "https"
+	}
+	cURL.Path = "/cleanup"
+	header := http.Header{}
+	if dialer.AuthMethod == AuthQuery {
+		q := cURL.Query()
+		q.Set(protocol.AuthQueryParam, dialer.Auth)
+		cURL.RawQuery = q.Encode()
+	} else {
+		// Subprotocols only exist on upgrades, so plain requests use a header.
+		header.Set("Authorization", "Bearer "+dialer.Auth)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "POST", cURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header = header
+
+	// The request goes the same way as the WebSockets do, and its connection
+	// isn't kept around after it.
+	transport := &http.Transport{
+		DialContext:     dialer.NetDial,
+		TLSClientConfig: dialer.TLSConfig,
+	}
+	defer transport.CloseIdleConnections()
+	client := http.Client{Transport: transport}
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return errors.New("failed to cleanup user: " + res.Status + " (" + strconv.Itoa(res.StatusCode) + ")")
+	}
+
+	return nil
+}
+
+func (dialer *Dialer) endpointURL() (*url.URL, error) {
+	pURL, err := url.Parse(dialer.URL)
+	if err != nil {
+		return nil, err
+	}
+	switch pURL.Scheme {
+	case "ws", "wss":
+	case "http":
+		pURL.Scheme = "ws"
+	case "https":
+		pURL.Scheme = "wss"
+	default:
+		return nil, errors.New("unsupported url scheme: " + pURL.Scheme)
+	}
+	if pURL.Path == "" {
+		pURL.Path = "/"
+	}
+	return pURL, nil
+}
+
+// handshake is what the server agreed to when the tunnel was upgraded.
+// Servers that predate versioning don't answer and speak version 1.
+type handshake struct {
+	version      int
+	capabilities protocol.Capabilities
+}
+
+func (dialer *Dialer) dialWS(ctx context.Context, network string, endpoint string) (*wsConn, handshake, error) {
+	pURL, err := dialer.endpointURL()
+	if err != nil {
+		return nil, handshake{}, err
+	}
+	pQuery := pURL.Query()
+	if endpoint != "" {
+		pQuery.Set(protocol.EndpointQueryParam, endpoint)
+	}
+	pQuery.Set(protocol.NetworkQueryParam, network)
+	pQuery.Set(protocol.VersionQueryParam, strconv.Itoa(protocol.LatestVersion))
+	pQuery.Set(protocol.CapabilitiesQueryParam, (protocol.CapMux | protocol.CapUDPDomain | protocol.CapHalfClose).String())
+
+	hs := handshake{version: protocol.Version1}
+	var rejected ws.StatusCode
+	wsDialer := ws.Dialer{
+		Timeout:   dialer.HandshakeTimeout,
+		TLSConfig: dialer.TLSConfig,
+		NetDial:   dialer.NetDial,
+		OnHeader: func(key, value []byte) error {
+			switch http.CanonicalHeaderKey(string(key)) {
+			case protocol.VersionHeader:
+				version, err := strconv.Atoi(string(value))
+				if err != nil || version < protocol.Version1 || version > protocol.LatestVersion {
+					return errors.New("server selected unsupported version: " + string(value))
+				}
+				hs.version = version
+			case protocol.CapabilitiesHeader:
+				hs.capabilities = protocol.ParseCapabilities(string(value))
+			case protocol.CloseCodeHeader:
+				code, err := strconv.Atoi(string(value))
+				if err != nil || code <= 0 || code > 0xffff {
+					return errors.New("server sent invalid close code: " + string(value))
+				}
+				rejected = ws.StatusCode(code)
+			}
+			return nil
+		},
+	}
+	switch dialer.AuthMethod {
+	case AuthQuery:
+		pQuery.Set(protocol.AuthQueryParam, dialer.Auth)
+	case AuthHeader:
+		wsDialer.Header = ws.HandshakeHeaderHTTP(http.Header{"Authorization": {"Bearer " + dialer.Auth}})
+	case AuthSubprotocol:
+		wsDialer.Protocols = []string{protocol.VersionSubprotocol(protocol.LatestVersion), protocol.Subprotocol, protocol.AuthSubprotocol(dialer.Auth)}
+	case AuthCookie:
+		cookie := &http.Cookie{Name: protocol.AuthCookieName, Value: dialer.Auth}
+		wsDialer.Header = ws.HandshakeHeaderHTTP(http.Header{"Cookie": {cookie.String()}})
+	default:
+		return nil, handshake{}, errors.New("unsupported auth method: " + strconv.Itoa(int(dialer.AuthMethod)))
+	}
+	pURL.RawQuery = pQuery.Encode()
+	conn, br, _, err := wsDialer.Dial(ctx, pURL.String())
+	if err != nil {
+		return nil, handshake{}, err
+	}
+	wc := newWSConn(conn, br)
+	if rejected != 0 {
+		return nil, handshake{}, wc.rejection(rejected)
+	}
+
+	return wc, hs, nil
+}
+
+type Addr struct {
+	Net     string
+	Address string
+}
+
+func (addr *Addr) Network() string {
+	return addr.Net
+}
+
+func (addr *Addr) String() string {
+	return addr.Address
+}
@@ -0,0 +1,119 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/b00tkitism/wsc/client"
+	"github.com/b00tkitism/wsc/proxy"
+)
+
+type testAuth struct{}
+
+func (testAuth) AuthenticateSession(ctx context.Context, auth string) (*proxy.AuthResult, error) {
+	return &proxy.AuthResult{UserID: 1}, nil
+}
+
+func (testAuth) ReportUsage(ctx context.Context, record proxy.UsageRecord) error {
+	return nil
+}
+
+// startProxy serves a proxy.Proxy that may reach loopback and an echo server
+// for it to reach, and returns their addresses.
+func startProxy(t *testing.T) (string, string) {
+	t.Helper()
+	echo, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		for {
+			conn, err := echo.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+
+	pro := proxy.NewProxy(testAuth{}, 4, time.Hour, 1<<40)
+	pro.DestinationPolicy = &proxy.DestinationPolicy{Default: proxy.PolicyAllow}
+	server := httptest.NewServer(pro)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		pro.Shutdown(ctx)
+		server.Close()
+	})
+	return server.Listener.Addr().String(), echo.Addr().String()
+}
+
+func roundTrip(t *testing.T, conn net.Conn) {
+	t.Helper()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	sent := bytes.Repeat([]byte("wsc round trip "), 10000)
+	go conn.Write(sent)
+	received := make([]byte, len(sent))
+	if _, err := io.ReadFull(conn, received); err != nil {
+		t.Fatalf("ReadFull: %v", err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Fatal("echo doesn't match what was written")
+	}
+}
+
+func TestDialerRoundTrip(t *testing.T) {
+	proxyAddr, echoAddr := startProxy(t)
+	for _, multiplex := range []bool{false, true} {
+		dialer := &client.Dialer{URL: "ws://" + proxyAddr + "/", Auth: "token", Multiplex: multiplex}
+		for range 2 {
+			conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+			if err != nil {
+				t.Fatalf("DialContext (multiplex %v): %v", multiplex, err)
+			}
+			roundTrip(t, conn)
+			conn.Close()
+		}
+	}
+}
+
+func TestDialerCleanup(t *testing.T) {
+	proxyAddr, echoAddr := startProxy(t)
+	var dials atomic.Int32
+	dialer := &client.Dialer{
+		URL:  "ws://" + proxyAddr + "/",
+		Auth: "token",
+		NetDial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			dials.Add(1)
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	conn, err := dialer.DialContext(context.Background(), "tcp", echoAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	roundTrip(t, conn)
+
+	if err := dialer.Cleanup(context.Background()); err != nil {
+		t.Fatalf("Cleanup: %v", err)
+	}
+	if n := dials.Load(); n != 2 {
+		t.Errorf("NetDial was called %d times, want once for the tunnel and once for Cleanup", n)
+	}
+	// Cleanup drops the user along with its connections.
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("tunnel is still open after Cleanup")
+	}
+}
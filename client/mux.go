@@ -0,0 +1,115 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+
+	"github.com/b00tkitism/wsc/internal/mux"
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+	"github.com/itsabgr/ge"
+)
+
+var _ mux.FrameConn = &muxFrameConn{}
+
+type muxFrameConn struct {
+	ws *wsConn
+}
+
+func (fc *muxFrameConn) ReadFrame() ([]byte, error) {
+	for {
+		op, data, err := fc.ws.readMessage()
+		if err != nil {
+			return nil, err
+		}
+		if op == ws.OpBinary {
+			return data, nil
+		}
+	}
+}
+
+func (fc *muxFrameConn) WriteFrame(data []byte) error {
+	return fc.ws.writeMessage(ws.OpBinary, data)
+}
+
+func (fc *muxFrameConn) Close() error {
+	return fc.ws.close(ws.StatusNormalClosure, "")
+}
+
+// muxConn is a stream opened by DialContext. Mux frames have no way to end
+// one direction only.
+type muxConn struct {
+	*mux.Stream
+}
+
+func (conn muxConn) CloseWrite() error {
+	return ErrHalfCloseUnsupported
+}
+
+type MuxSession struct {
+	session *mux.Session
+}
+
+func (dialer *Dialer) DialMux(ctx context.Context) (*MuxSession, error) {
+	wsConn, hs, err := dialer.dialWS(ctx, "mux", "")
+	if err != nil {
+		return nil, err
+	}
+	if dialer.PingInterval > 0 {
+		go wsConn.keepAlive(dialer.PingInterval)
+	}
+
+	return &MuxSession{
+		session: mux.NewClientSession(&muxFrameConn{ws: wsConn}, mux.Config{CloseCodes: hs.version >= protocol.Version2}),
+	}, nil
+}
+
+func (dialer *Dialer) sharedMux(ctx context.Context) (*MuxSession, error) {
+	dialer.muxMutex.Lock()
+	defer dialer.muxMutex.Unlock()
+
+	if dialer.mux != nil {
+		select {
+		case <-dialer.mux.Done():
+		default:
+			return dialer.mux, nil
+		}
+	}
+
+	session, err := dialer.DialMux(ctx)
+	if err != nil {
+		return nil, err
+	}
+	dialer.mux = session
+	return session, nil
+}
+
+func (session *MuxSession) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, errors.New("unsupported network: " + network)
+	}
+
+	stream, err := session.session.Open(ctx, address)
+	if err != nil {
+		if closeErr, ok := ge.As[*mux.CloseError](err); ok {
+			return nil, &CloseError{Code: ws.StatusCode(closeErr.Code), Reason: closeErr.Reason}
+		}
+		return nil, err
+	}
+	return muxConn{stream}, nil
+}
+
+func (session *MuxSession) NumStreams() int {
+	return session.session.NumStreams()
+}
+
+func (session *MuxSession) Done() <-chan struct{} {
+	return session.session.Done()
+}
+
+func (session *MuxSession) Close() error {
+	return session.session.Close()
+}
@@ -0,0 +1,178 @@
+package client
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+var _ net.PacketConn = &PacketConn{}
+
+// PacketConn relays datagrams over a net=udp tunnel. When the server grants
+// protocol.CapUDPDomain, WriteTo sends domain destinations for the server to
+// resolve and ReadFrom reports replies from them by the same name, as an
+// *Addr. Otherwise domains are resolved locally.
+type PacketConn struct {
+	ws      *wsConn
+	framed  bool
+	domains bool
+
+	readMutex sync.Mutex
+	readErr   error
+}
+
+func newPacketConn(wc *wsConn, pingInterval time.Duration, hs handshake) *PacketConn {
+	if pingInterval > 0 {
+		go wc.keepAlive(pingInterval)
+	}
+	return &PacketConn{
+		ws:      wc,
+		framed:  hs.version >= protocol.Version2,
+		domains: hs.capabilities.Has(protocol.CapUDPDomain),
+	}
+}
+
+func (conn *PacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+
+	if conn.readErr != nil {
+		return 0, nil, conn.readErr
+	}
+
+	for {
+		_, data, err := conn.ws.readMessage()
+		if err != nil {
+			if !isTimeoutErr(err) {
+				conn.readErr = err
+			}
+			return 0, nil, err
+		}
+
+		if conn.framed {
+			frame := protocol.PacketFrame{}
+			if err := frame.UnmarshalBinaryUnsafe(data); err != nil {
+				continue
+			}
+			if frame.Domain != "" {
+				return copy(p, frame.Payload), &Addr{Net: "udp", Address: frame.Host()}, nil
+			}
+			addrPort := netip.AddrPortFrom(frame.Addr.Unmap(), frame.Port)
+			return copy(p, frame.Payload), net.UDPAddrFromAddrPort(addrPort), nil
+		}
+
+		payload := protocol.PacketConnPayload{}
+		if err := payload.UnmarshalBinaryUnsafe(data); err != nil {
+			continue
+		}
+
+		addrPort := netip.AddrPortFrom(payload.AddrPort.Addr().Unmap(), payload.AddrPort.Port())
+		return copy(p, payload.Payload), net.UDPAddrFromAddrPort(addrPort), nil
+	}
+}
+
+func (conn *PacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	var data []byte
+	var err error
+	if conn.framed {
+		data, err = packetFrame(p, addr, conn.domains)
+	} else {
+		data, err = legacyPacketPayload(p, addr)
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	if err := conn.ws.writeMessage(ws.OpBinary, data); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (conn *PacketConn) Close() error {
+	return conn.ws.close(ws.StatusNormalClosure, "")
+}
+
+func (conn *PacketConn) LocalAddr() net.Addr {
+	return conn.ws.conn.LocalAddr()
+}
+
+func (conn *PacketConn) SetDeadline(t time.Time) error {
+	return conn.ws.conn.SetDeadline(t)
+}
+
+func (conn *PacketConn) SetReadDeadline(t time.Time) error {
+	return conn.ws.conn.SetReadDeadline(t)
+}
+
+func (conn *PacketConn) SetWriteDeadline(t time.Time) error {
+	return conn.ws.conn.SetWriteDeadline(t)
+}
+
+func packetFrame(p []byte, addr net.Addr, domains bool) ([]byte, error) {
+	frame := protocol.PacketFrame{Payload: p}
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		addrPort := udpAddr.AddrPort()
+		frame.Addr, frame.Port = addrPort.Addr(), addrPort.Port()
+		return frame.MarshalBinary()
+	}
+	if addr == nil {
+		return nil, errors.New("missing address")
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil, err
+	}
+	portNum, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return nil, errors.New("invalid port: " + port)
+	}
+	frame.Port = uint16(portNum)
+	if ip, err := netip.ParseAddr(host); err == nil {
+		frame.Addr = ip
+	} else if domains {
+		frame.Domain = host
+	} else {
+		addrPort, err := udpAddrPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		frame.Addr = addrPort.Addr()
+	}
+	return frame.MarshalBinary()
+}
+
+func legacyPacketPayload(p []byte, addr net.Addr) ([]byte, error) {
+	addrPort, err := udpAddrPort(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	payload := protocol.PacketConnPayload{
+		AddrPort: addrPort,
+		Payload:  p,
+	}
+	return payload.MarshalBinary()
+}
+
+func udpAddrPort(addr net.Addr) (netip.AddrPort, error) {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.AddrPort(), nil
+	case nil:
+		return netip.AddrPort{}, errors.New("missing address")
+	default:
+		udpAddr, err := net.ResolveUDPAddr("udp", addr.String())
+		if err != nil {
+			return netip.AddrPort{}, err
+		}
+		return udpAddr.AddrPort(), nil
+	}
+}
@@ -0,0 +1,14 @@
+package client
+
+import (
+	"net"
+
+	"github.com/itsabgr/ge"
+)
+
+func isTimeoutErr(err error) bool {
+	if nErr, ok := ge.As[net.Error](err); ok && nErr.Timeout() {
+		return true
+	}
+	return false
+}
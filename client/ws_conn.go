@@ -0,0 +1,201 @@
+package client
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+)
+
+const closeWriteTimeout = time.Second
+
+type wsConn struct {
+	conn   net.Conn
+	source *bufio.Reader
+	reader *wsutil.Reader
+
+	// The data message being read, kept across read deadlines.
+	messageOp ws.OpCode
+	message   []byte
+
+	writeMutex sync.Mutex
+	closeOnce  sync.Once
+	closed     chan struct{}
+}
+
+func newWSConn(conn net.Conn, br *bufio.Reader) *wsConn {
+	if br == nil {
+		br = bufio.NewReader(conn)
+	}
+	wc := &wsConn{
+		conn:   conn,
+		source: br,
+		closed: make(chan struct{}),
+	}
+	wc.reader = wsutil.NewReader(br, ws.StateClientSide)
+	wc.reader.OnIntermediate = func(header ws.Header, r io.Reader) error {
+		return wc.handleControl(header, r)
+	}
+	return wc
+}
+
+// nextMessage returns the opcode of the next data message, answering control
+// frames on the way.
+func (wc *wsConn) nextMessage() (ws.OpCode, error) {
+	for {
+		if err := wc.peekHeader(); err != nil {
+			return 0, err
+		}
+		header, err := wc.reader.NextFrame()
+		if err != nil {
+			return 0, err
+		}
+		if header.OpCode.IsControl() {
+			if err := wc.handleControl(header, wc.reader); err != nil {
+				return 0, err
+			}
+			continue
+		}
+		return header.OpCode, nil
+	}
+}
+
+// peekHeader buffers the next frame header, and the payload of control
+// frames, without consuming it. A read deadline firing halfway through a
+// header then leaves it for the next call instead of desynchronizing the
+// stream. The server sends every data message in a single frame, so headers
+// are only ever read here.
+func (wc *wsConn) peekHeader() error {
+	b, err := wc.source.Peek(2)
+	if err != nil {
+		return err
+	}
+	n := 2
+	switch length := int(b[1] & 0x7f); {
+	case length == 126:
+		n += 2
+	case length == 127:
+		n += 8
+	case b[0]&0x08 != 0:
+		n += length
+	}
+	if b[1]&0x80 != 0 {
+		n += 4
+	}
+	_, err = wc.source.Peek(n)
+	return err
+}
+
+// readMessage returns the next data message. When a read deadline interrupts
+// it, the part read so far is kept and the next call continues from there.
+func (wc *wsConn) readMessage() (ws.OpCode, []byte, error) {
+	if wc.messageOp == 0 {
+		op, err := wc.nextMessage()
+		if err != nil {
+			return 0, nil, err
+		}
+		wc.messageOp = op
+	}
+	data, err := wc.readPayload()
+	if err != nil {
+		return 0, nil, err
+	}
+	op := wc.messageOp
+	wc.messageOp = 0
+	return op, data, nil
+}
+
+// readPayload reads the rest of the current message, keeping what it got in
+// wc.message when it fails.
+func (wc *wsConn) readPayload() ([]byte, error) {
+	for {
+		if len(wc.message) == cap(wc.message) {
+			wc.message = slices.Grow(wc.message, 512)
+		}
+		n, err := wc.reader.Read(wc.message[len(wc.message):cap(wc.message)])
+		wc.message = wc.message[:len(wc.message)+n]
+		if errors.Is(err, io.EOF) {
+			data := wc.message
+			wc.message = nil
+			return data, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (wc *wsConn) handleControl(header ws.Header, r io.Reader) error {
+	payload, err := io.ReadAll(io.LimitReader(r, header.Length))
+	if err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+
+	switch header.OpCode {
+	case ws.OpPing:
+		return wc.writeMessage(ws.OpPong, payload)
+	case ws.OpPong:
+		return nil
+	case ws.OpClose:
+		code, reason := ws.ParseCloseFrameData(payload)
+		wc.close(ws.StatusNormalClosure, "")
+		if code.Empty() || code == ws.StatusNormalClosure {
+			return io.EOF
+		}
+		return &CloseError{Code: code, Reason: reason}
+	}
+	return nil
+}
+
+// rejection reads the close frame of a tunnel the server refused on the
+// handshake and returns it as a *CloseError.
+func (wc *wsConn) rejection(code ws.StatusCode) error {
+	defer wc.conn.Close()
+	wc.conn.SetReadDeadline(time.Now().Add(closeWriteTimeout))
+	_, err := wc.nextMessage()
+	if closeErr, ok := err.(*CloseError); ok {
+		return closeErr
+	}
+	return &CloseError{Code: code, Reason: protocol.CloseCode(code).String()}
+}
+
+func (wc *wsConn) writeMessage(op ws.OpCode, p []byte) error {
+	wc.writeMutex.Lock()
+	defer wc.writeMutex.Unlock()
+	return wsutil.WriteClientMessage(wc.conn, op, p)
+}
+
+func (wc *wsConn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wc.closed:
+			return
+		case <-ticker.C:
+			if err := wc.writeMessage(ws.OpPing, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (wc *wsConn) close(code ws.StatusCode, reason string) error {
+	err := net.ErrClosed
+	wc.closeOnce.Do(func() {
+		close(wc.closed)
+		wc.writeMutex.Lock()
+		wc.conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		wsutil.WriteClientMessage(wc.conn, ws.OpClose, ws.NewCloseFrameBody(code, reason))
+		wc.writeMutex.Unlock()
+		err = wc.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+// trickle writes frames to conn a few bytes at a time, pausing long enough
+// for the reader's deadline to fire in the middle of headers and payloads.
+func trickle(t *testing.T, conn net.Conn, frames ...ws.Frame) {
+	t.Helper()
+	buf := bytes.Buffer{}
+	for _, frame := range frames {
+		if err := ws.WriteFrame(&buf, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	go func() {
+		data := buf.Bytes()
+		for len(data) > 0 {
+			n := min(len(data), 3)
+			if _, err := conn.Write(data[:n]); err != nil {
+				return
+			}
+			data = data[n:]
+			time.Sleep(15 * time.Millisecond)
+		}
+	}()
+}
+
+func TestReadMessageResumesAfterTimeout(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	wc := newWSConn(clientSide, nil)
+
+	long := bytes.Repeat([]byte("0123456789"), 20)
+	trickle(t, serverSide,
+		ws.NewBinaryFrame([]byte("first")),
+		ws.NewPingFrame([]byte("ping")),
+		ws.NewBinaryFrame(long),
+	)
+	go func() {
+		// Drain the pong so handleControl doesn't block on the pipe.
+		buf := make([]byte, 64)
+		for {
+			if _, err := serverSide.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	var got [][]byte
+	timeouts := 0
+	deadline := time.Now().Add(10 * time.Second)
+	for len(got) < 2 && time.Now().Before(deadline) {
+		wc.conn.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+		op, data, err := wc.readMessage()
+		if err != nil {
+			if !isTimeoutErr(err) {
+				t.Fatalf("readMessage: %v", err)
+			}
+			timeouts++
+			continue
+		}
+		if op != ws.OpBinary {
+			t.Errorf("got opcode %v", op)
+		}
+		got = append(got, data)
+	}
+
+	if len(got) != 2 || string(got[0]) != "first" || !bytes.Equal(got[1], long) {
+		t.Fatalf("got %q, want the two messages intact", got)
+	}
+	if timeouts == 0 {
+		t.Error("no read timed out, so nothing was resumed")
+	}
+}
+
+func TestConnReadResumesAfterTimeout(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	defer clientSide.Close()
+	defer serverSide.Close()
+	conn := &Conn{ws: newWSConn(clientSide, nil), halfClose: true}
+
+	trickle(t, serverSide,
+		ws.NewBinaryFrame([]byte("stream data")),
+		ws.NewTextFrame([]byte(protocol.HalfCloseMessage)),
+	)
+
+	got := []byte{}
+	buf := make([]byte, 4)
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Millisecond))
+		n, err := conn.Read(buf)
+		got = append(got, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil && !isTimeoutErr(err) {
+			t.Fatalf("Read: %v", err)
+		}
+	}
+	if string(got) != "stream data" {
+		t.Errorf("read %q before the half-close, want \"stream data\"", got)
+	}
+}
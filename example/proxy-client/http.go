@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/b00tkitism/wsc/client"
+)
+
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+type HTTPProxyServer struct {
+	Dialer   *client.Dialer
+	Username string
+	Password string
+	Timeout  time.Duration
+
+	transport *http.Transport
+}
+
+func NewHTTPProxyServer(dialer *client.Dialer, username string, password string, timeout time.Duration) *HTTPProxyServer {
+	return &HTTPProxyServer{
+		Dialer:   dialer,
+		Username: username,
+		Password: password,
+		Timeout:  timeout,
+		transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     time.Minute,
+		},
+	}
+}
+
+func (server *HTTPProxyServer) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	for {
+		if err := conn.SetReadDeadline(time.Now().Add(server.Timeout)); err != nil {
+			return
+		}
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			if !errors.Is(err, io.EOF) {
+				slog.Debug("http proxy request failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()))
+			}
+			return
+		}
+		if err := conn.SetReadDeadline(time.Time{}); err != nil {
+			return
+		}
+
+		if !server.authorized(request) {
+			writeHTTPResponse(conn, http.StatusProxyAuthRequired, http.Header{"Proxy-Authenticate": {`Basic realm="wsc"`}})
+			return
+		}
+
+		if request.Method == http.MethodConnect {
+			server.handleConnect(ctx, conn, reader, request)
+			return
+		}
+
+		if !server.handleForward(ctx, conn, request) {
+			return
+		}
+	}
+}
+
+func (server *HTTPProxyServer) authorized(request *http.Request) bool {
+	if server.Username == "" && server.Password == "" {
+		return true
+	}
+	auth := request.Header.Get("Proxy-Authorization")
+	encoded, ok := strings.CutPrefix(auth, "Basic ")
+	if !ok {
+		return false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return false
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return false
+	}
+	usernameOK := subtle.ConstantTimeCompare([]byte(username), []byte(server.Username)) == 1
+	passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(server.Password)) == 1
+	return usernameOK && passwordOK
+}
+
+func (server *HTTPProxyServer) handleConnect(ctx context.Context, conn net.Conn, reader *bufio.Reader, request *http.Request) {
+	remote, err := server.Dialer.DialContext(ctx, "tcp", request.Host)
+	if err != nil {
+		slog.Debug("http connect failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()), slog.String("destination", request.Host))
+		writeHTTPResponse(conn, http.StatusBadGateway, nil)
+		return
+	}
+	defer remote.Close()
+
+	if _, err := io.WriteString(conn, "HTTP/1.1 200 Connection Established\r\n\r\n"); err != nil {
+		return
+	}
+
+	if buffered := reader.Buffered(); buffered > 0 {
+		data, _ := reader.Peek(buffered)
+		if _, err := remote.Write(data); err != nil {
+			return
+		}
+	}
+
+	relay(conn, remote)
+}
+
+func (server *HTTPProxyServer) handleForward(ctx context.Context, conn net.Conn, request *http.Request) bool {
+	if !request.URL.IsAbs() || request.URL.Scheme != "http" {
+		writeHTTPResponse(conn, http.StatusBadRequest, nil)
+		return false
+	}
+
+	keepAlive := !request.Close
+	for _, header := range hopHeaders {
+		request.Header.Del(header)
+	}
+	request.RequestURI = ""
+	request = request.WithContext(ctx)
+
+	response, err := server.transport.RoundTrip(request)
+	if err != nil {
+		slog.Debug("http forward failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()), slog.String("destination", request.URL.Host))
+		writeHTTPResponse(conn, http.StatusBadGateway, nil)
+		return false
+	}
+	defer response.Body.Close()
+
+	for _, header := range hopHeaders {
+		response.Header.Del(header)
+	}
+	response.Close = !keepAlive
+	if err := response.Write(conn); err != nil {
+		return false
+	}
+	return keepAlive
+}
+
+func writeHTTPResponse(conn net.Conn, status int, header http.Header) error {
+	response := &http.Response{
+		StatusCode: status,
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     header,
+		Close:      true,
+	}
+	return response.Write(conn)
+}
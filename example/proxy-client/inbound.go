@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+)
+
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *peekedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+// serveInbound accepts SOCKS5 and HTTP proxy clients on the same listener,
+// telling them apart by the first byte (SOCKS5 always opens with 0x05).
+func serveInbound(ctx context.Context, listener net.Listener, socksServer *SOCKSServer, httpServer *HTTPProxyServer) error {
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go func() {
+			reader := bufio.NewReader(conn)
+			if err := conn.SetReadDeadline(time.Now().Add(socksServer.Timeout)); err != nil {
+				conn.Close()
+				return
+			}
+			first, err := reader.Peek(1)
+			if err != nil {
+				slog.Debug("inbound sniffing failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()))
+				conn.Close()
+				return
+			}
+			pConn := &peekedConn{Conn: conn, reader: reader}
+			if first[0] == socksVersion5 {
+				socksServer.ServeConn(ctx, pConn)
+			} else {
+				httpServer.ServeConn(ctx, pConn)
+			}
+		}()
+	}
+}
+
+// relay copies both ways until both sides are done, passing a half-close on
+// to the other side where it can be expressed and closing it otherwise.
+func relay(local net.Conn, remote net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(local, remote)
+		if closeWrite(local) != nil {
+			local.Close()
+		}
+	}()
+	io.Copy(remote, local)
+	if closeWrite(remote) != nil {
+		remote.Close()
+	}
+	<-done
+	local.Close()
+	remote.Close()
+}
+
+func closeWrite(conn net.Conn) error {
+	if peeked, ok := conn.(*peekedConn); ok {
+		conn = peeked.Conn
+	}
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
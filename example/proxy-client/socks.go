@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"time"
+
+	"github.com/b00tkitism/wsc/client"
+)
+
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdBind         = 0x02
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded               = 0x00
+	socksReplyGeneralFailure          = 0x01
+	socksReplyNotAllowed              = 0x02
+	socksReplyNetworkUnreachable      = 0x03
+	socksReplyHostUnreachable         = 0x04
+	socksReplyConnectionRefused       = 0x05
+	socksReplyTTLExpired              = 0x06
+	socksReplyCommandNotSupported     = 0x07
+	socksReplyAddressTypeNotSupported = 0x08
+)
+
+type socksAddr struct {
+	host string
+	port uint16
+}
+
+func (addr socksAddr) String() string {
+	return net.JoinHostPort(addr.host, strconv.Itoa(int(addr.port)))
+}
+
+type SOCKSServer struct {
+	Dialer  *client.Dialer
+	Timeout time.Duration
+}
+
+func (server *SOCKSServer) ServeConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(server.Timeout)); err != nil {
+		return
+	}
+	if err := server.handshake(conn); err != nil {
+		slog.Debug("socks handshake failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()))
+		return
+	}
+
+	cmd, dst, err := readSOCKSRequest(conn)
+	if err != nil {
+		slog.Debug("socks request failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()))
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		return
+	}
+
+	switch cmd {
+	case socksCmdConnect:
+		server.handleConnect(ctx, conn, dst)
+	case socksCmdUDPAssociate:
+		server.handleUDPAssociate(ctx, conn, dst)
+	default:
+		writeSOCKSReply(conn, socksReplyCommandNotSupported, nil)
+	}
+}
+
+func (server *SOCKSServer) handshake(conn net.Conn) error {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksVersion5 {
+		return errors.New("unsupported socks version " + strconv.Itoa(int(header[0])))
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return err
+	}
+	for _, method := range methods {
+		if method == socksMethodNoAuth {
+			_, err := conn.Write([]byte{socksVersion5, socksMethodNoAuth})
+			return err
+		}
+	}
+	conn.Write([]byte{socksVersion5, socksMethodNoAcceptable})
+	return errors.New("no acceptable authentication method")
+}
+
+func (server *SOCKSServer) handleConnect(ctx context.Context, conn net.Conn, dst socksAddr) {
+	remote, err := server.Dialer.DialContext(ctx, "tcp", dst.String())
+	if err != nil {
+		slog.Debug("socks connect failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()), slog.String("destination", dst.String()))
+		writeSOCKSReply(conn, socksReplyFor(err), nil)
+		return
+	}
+	defer remote.Close()
+
+	if err := writeSOCKSReply(conn, socksReplySucceeded, nil); err != nil {
+		return
+	}
+
+	relay(conn, remote)
+}
+
+// socksReplyFor picks the reply code for a failed dial from the close code the
+// server refused the tunnel with.
+func socksReplyFor(err error) byte {
+	switch {
+	case errors.Is(err, client.ErrDialRefused):
+		return socksReplyConnectionRefused
+	case errors.Is(err, client.ErrDNSFailure), errors.Is(err, client.ErrHostUnreachable):
+		return socksReplyHostUnreachable
+	case errors.Is(err, client.ErrPolicyDenied), errors.Is(err, client.ErrQuotaExceeded):
+		return socksReplyNotAllowed
+	case errors.Is(err, client.ErrEvicted), errors.Is(err, client.ErrServerShutdown):
+		return socksReplyGeneralFailure
+	}
+	return socksReplyHostUnreachable
+}
+
+func readSOCKSRequest(conn net.Conn) (byte, socksAddr, error) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return 0, socksAddr{}, err
+	}
+	if header[0] != socksVersion5 {
+		return 0, socksAddr{}, errors.New("unsupported socks version " + strconv.Itoa(int(header[0])))
+	}
+	dst, err := readSOCKSAddr(conn)
+	if err != nil {
+		return 0, socksAddr{}, err
+	}
+	return header[1], dst, nil
+}
+
+func readSOCKSAddr(r io.Reader) (socksAddr, error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return socksAddr{}, err
+	}
+
+	var host string
+	switch atyp[0] {
+	case socksAtypIPv4:
+		ip := make([]byte, 4)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return socksAddr{}, err
+		}
+		host = netip.AddrFrom4([4]byte(ip)).String()
+	case socksAtypIPv6:
+		ip := make([]byte, 16)
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return socksAddr{}, err
+		}
+		host = netip.AddrFrom16([16]byte(ip)).String()
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return socksAddr{}, err
+		}
+		domain := make([]byte, length[0])
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return socksAddr{}, err
+		}
+		host = string(domain)
+	default:
+		return socksAddr{}, errors.New("unsupported address type " + strconv.Itoa(int(atyp[0])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return socksAddr{}, err
+	}
+
+	return socksAddr{host: host, port: binary.BigEndian.Uint16(port)}, nil
+}
+
+func appendSOCKSAddr(data []byte, addr socksAddr) []byte {
+	if ip, err := netip.ParseAddr(addr.host); err == nil {
+		ip = ip.Unmap()
+		if ip.Is4() {
+			data = append(data, socksAtypIPv4)
+		} else {
+			data = append(data, socksAtypIPv6)
+		}
+		data = append(data, ip.AsSlice()...)
+	} else {
+		data = append(data, socksAtypDomain, byte(len(addr.host)))
+		data = append(data, addr.host...)
+	}
+	return binary.BigEndian.AppendUint16(data, addr.port)
+}
+
+func writeSOCKSReply(conn net.Conn, reply byte, bind net.Addr) error {
+	bindAddr := socksAddr{host: "0.0.0.0"}
+	if bind != nil {
+		if addrPort, err := netip.ParseAddrPort(bind.String()); err == nil {
+			bindAddr = socksAddr{host: addrPort.Addr().String(), port: addrPort.Port()}
+		}
+	}
+	_, err := conn.Write(appendSOCKSAddr([]byte{socksVersion5, reply, 0x00}, bindAddr))
+	return err
+}
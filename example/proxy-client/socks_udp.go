@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+
+	"github.com/b00tkitism/wsc/client"
+)
+
+const (
+	socksUDPBufferSize = 65535
+	socksUDPMaxTunnels = 64
+)
+
+type udpAssociation struct {
+	server   *SOCKSServer
+	udpConn  *net.UDPConn
+	clientIP netip.Addr
+
+	mutex      sync.Mutex
+	clientAddr netip.AddrPort
+	tunnels    map[string]net.PacketConn
+}
+
+func (server *SOCKSServer) handleUDPAssociate(ctx context.Context, conn net.Conn, _ socksAddr) {
+	localAddr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok {
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	remoteAddr, err := netip.ParseAddrPort(conn.RemoteAddr().String())
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+
+	udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: localAddr.IP, Zone: localAddr.Zone})
+	if err != nil {
+		writeSOCKSReply(conn, socksReplyGeneralFailure, nil)
+		return
+	}
+	defer udpConn.Close()
+
+	if err := writeSOCKSReply(conn, socksReplySucceeded, udpConn.LocalAddr()); err != nil {
+		return
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// The association lives exactly as long as the controlling TCP connection.
+	go func() {
+		io.Copy(io.Discard, conn)
+		cancel()
+		udpConn.Close()
+	}()
+
+	association := &udpAssociation{
+		server:   server,
+		udpConn:  udpConn,
+		clientIP: remoteAddr.Addr().Unmap(),
+		tunnels:  map[string]net.PacketConn{},
+	}
+	defer association.close()
+
+	if err := association.relayFromClient(ctx); err != nil && ctx.Err() == nil {
+		slog.Debug("socks udp association failed: "+err.Error(), slog.String("client", conn.RemoteAddr().String()))
+	}
+}
+
+func (association *udpAssociation) relayFromClient(ctx context.Context) error {
+	pack := make([]byte, socksUDPBufferSize)
+	for {
+		n, from, err := association.udpConn.ReadFromUDPAddrPort(pack)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		if from.Addr().Unmap() != association.clientIP {
+			continue
+		}
+
+		dst, payload, err := parseSOCKSDatagram(pack[:n])
+		if err != nil {
+			slog.Debug("dropping socks udp datagram: "+err.Error(), slog.String("client", from.String()))
+			continue
+		}
+
+		tunnel, err := association.ensureTunnel(ctx, from, dst)
+		if err != nil {
+			slog.Debug("dropping socks udp datagram: "+err.Error(), slog.String("destination", dst.String()))
+			continue
+		}
+
+		// Domains go to the server as they are, so DNS never leaks locally.
+		if _, err := tunnel.WriteTo(payload, &client.Addr{Net: "udp", Address: dst.String()}); err != nil {
+			slog.Debug("dropping socks udp datagram: "+err.Error(), slog.String("destination", dst.String()))
+			continue
+		}
+	}
+}
+
+// ensureTunnel returns the tunnel for dst, opening it on first use. Every
+// destination gets a tunnel of its own because a server with UDPPinEndpoint
+// only relays a tunnel's datagrams to the endpoint it was opened for.
+func (association *udpAssociation) ensureTunnel(ctx context.Context, from netip.AddrPort, dst socksAddr) (net.PacketConn, error) {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+
+	association.clientAddr = from
+	key := dst.String()
+	if tunnel, found := association.tunnels[key]; found {
+		return tunnel, nil
+	}
+	if len(association.tunnels) >= socksUDPMaxTunnels {
+		return nil, errors.New("too many udp destinations")
+	}
+
+	tunnel, err := association.server.Dialer.ListenPacket(ctx, "udp", key)
+	if err != nil {
+		return nil, err
+	}
+	association.tunnels[key] = tunnel
+	go association.relayToClient(key, tunnel)
+	return tunnel, nil
+}
+
+func (association *udpAssociation) relayToClient(key string, tunnel net.PacketConn) {
+	pack := make([]byte, socksUDPBufferSize)
+	for {
+		n, from, err := tunnel.ReadFrom(pack)
+		if err != nil {
+			// The next datagram to this destination opens a new tunnel.
+			association.mutex.Lock()
+			if association.tunnels[key] == tunnel {
+				delete(association.tunnels, key)
+			}
+			association.mutex.Unlock()
+			tunnel.Close()
+			return
+		}
+
+		host, port, err := net.SplitHostPort(from.String())
+		if err != nil {
+			continue
+		}
+		portNum, err := strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			continue
+		}
+		datagram := appendSOCKSAddr([]byte{0x00, 0x00, 0x00}, socksAddr{host: host, port: uint16(portNum)})
+		datagram = append(datagram, pack[:n]...)
+
+		association.mutex.Lock()
+		clientAddr := association.clientAddr
+		association.mutex.Unlock()
+
+		if _, err := association.udpConn.WriteToUDPAddrPort(datagram, clientAddr); err != nil {
+			return
+		}
+	}
+}
+
+func (association *udpAssociation) close() {
+	association.mutex.Lock()
+	defer association.mutex.Unlock()
+	for _, tunnel := range association.tunnels {
+		tunnel.Close()
+	}
+}
+
+func parseSOCKSDatagram(data []byte) (socksAddr, []byte, error) {
+	if len(data) < 4 {
+		return socksAddr{}, nil, errors.New("short datagram")
+	}
+	if data[2] != 0x00 {
+		return socksAddr{}, nil, errors.New("fragmented datagrams are not supported")
+	}
+	reader := bytes.NewReader(data[3:])
+	dst, err := readSOCKSAddr(reader)
+	if err != nil {
+		return socksAddr{}, nil, err
+	}
+	return dst, data[len(data)-reader.Len():], nil
+}
@@ -16,7 +16,7 @@ type CustomAuth struct {
 }
 
 func (c *CustomAuth) Authenticate(ctx context.Context, auth string) (int64, int64, error) {
-	slog.Debug("authenticating : ", slog.String("auth", auth))
+	slog.Debug("authenticating : ", slog.Int("auth-len", len(auth)))
 	return 1, 3 * 1024 * 1024, nil
 }
 
@@ -34,7 +34,7 @@ func (c *CustomAuth) ReportUsage(ctx context.Context, id int64, usedTraffic int6
 
 func main() {
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelDebug})))
-	pro := proxy.NewProxy(&CustomAuth{}, 30, time.Second*10, 1*1e6*1e4)
+	pro := proxy.NewProxy(proxy.AdaptAuthenticator(&CustomAuth{}), 30, time.Second*10, 1*1e6*1e4)
 	slog.Info("running...")
 	err := http.ListenAndServe(":4040", pro)
 	if err != nil {
@@ -10,29 +10,35 @@ import (
 	"github.com/b00tkitism/wsc/proxy"
 )
 
-var _ proxy.Authenticator = &CustomAuth{}
+var _ proxy.SessionAuthenticator = &CustomAuth{}
 
 type CustomAuth struct {
 	DB *Database
 }
 
-func (cauth *CustomAuth) Authenticate(ctx context.Context, auth string) (int64, int64, error) {
+func (cauth *CustomAuth) AuthenticateSession(ctx context.Context, auth string) (*proxy.AuthResult, error) {
 	id, rate, usedTraffic, totalTraffic, endTime, err := cauth.DB.FindUser(ctx, auth)
 	if err != nil {
-		return id, 0, errors.New("failed to find user '" + auth + "'. (Error: " + err.Error() + ")")
+		return &proxy.AuthResult{UserID: id}, errors.New("failed to find user. (Error: " + err.Error() + ")")
 	}
 	if time.Now().UnixNano() >= endTime {
-		return id, 0, errors.New("user service time exceeded '" + auth + "'(" + strconv.Itoa(int(id)) + ") at '" + time.Unix(0, endTime).String() + "'")
+		return &proxy.AuthResult{UserID: id}, errors.New("user service time exceeded (" + strconv.Itoa(int(id)) + ") at '" + time.Unix(0, endTime).String() + "'")
 	}
 	if usedTraffic >= totalTraffic {
 		usedTrafficStr := strconv.FormatFloat(float64(usedTraffic)/1024/1024, 'g', -1, 64) + "MB"
 		totalTrafficStr := strconv.FormatFloat(float64(totalTraffic)/1024/1024, 'g', -1, 64) + "MB"
 		remainedTrafficStr := strconv.FormatFloat(math.Max(float64(totalTraffic-usedTraffic)/1024/1024, 0), 'g', -1, 64) + "MB"
-		return 0, 0, errors.New("user service traffic exceeded '" + auth + "'(" + strconv.Itoa(int(id)) + "). [used_traffic = " + usedTrafficStr + ", total_traffic = " + totalTrafficStr + ", remained = " + remainedTrafficStr + "]")
+		return nil, errors.New("user service traffic exceeded (" + strconv.Itoa(int(id)) + "). [used_traffic = " + usedTrafficStr + ", total_traffic = " + totalTrafficStr + ", remained = " + remainedTrafficStr + "]")
 	}
-	return id, rate, nil
+	return &proxy.AuthResult{
+		UserID:         id,
+		RateLimit:      rate,
+		ExpiresAt:      time.Unix(0, endTime),
+		RemainingBytes: totalTraffic - usedTraffic,
+		HasQuota:       true,
+	}, nil
 }
 
-func (cauth *CustomAuth) ReportUsage(ctx context.Context, id int64, usedTraffic int64) error {
-	return cauth.DB.UpdateUser(ctx, id, usedTraffic)
+func (cauth *CustomAuth) ReportUsage(ctx context.Context, record proxy.UsageRecord) error {
+	return cauth.DB.AddUsage(ctx, record.ID, record.UserID, record.TotalBytes())
 }
@@ -46,6 +46,30 @@ func (db *Database) UpdateUser(ctx context.Context, id int64, usedTraffic int64)
 	return nil
 }
 
+// AddUsage is UpdateUser for a journaled usage report: a recordID that was
+// already applied is ignored, so a report delivered twice is only billed once.
+func (db *Database) AddUsage(ctx context.Context, recordID string, id int64, usedTraffic int64) error {
+	if recordID == "" {
+		return db.UpdateUser(ctx, id, usedTraffic)
+	}
+	tx, err := db.Handle.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO `usage_reports`(`id`, `user_id`, `traffic`) VALUES (?, ?, ?)", recordID, id, usedTraffic)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE `users` SET `used_traffic`=`used_traffic`+? WHERE `id`=?", usedTraffic, id); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
 func (db *Database) ChargeUserService(ctx context.Context, auth string, rate int64, totalTraffic int64, duration time.Duration) error {
 	now := time.Now().UnixNano()
 	endTime := now + int64(duration)
@@ -91,6 +115,15 @@ func (db *Database) CreateUser(ctx context.Context, auth string, rate int64, tot
 }
 
 func (db *Database) createTables(ctx context.Context) error {
+	if _, err := db.Handle.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS usage_reports (
+		    'id'      TEXT NOT NULL PRIMARY KEY,
+		    'user_id' INTEGER NOT NULL,
+		    'traffic' INTEGER NOT NULL
+		)
+	`); err != nil {
+		return err
+	}
 	statement, err := db.Handle.PrepareContext(ctx, `
 		CREATE TABLE IF NOT EXISTS users (
 		    'id'            INTEGER NOT NULL UNIQUE,
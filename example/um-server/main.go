@@ -16,6 +16,10 @@ import (
 )
 
 var dbFilePath = flag.String("db", "./database.db", "sqlite database")
+var metricsAddr = flag.String("metrics", "127.0.0.1:9090", "metrics listen address, empty to disable")
+var adminAddr = flag.String("admin", "127.0.0.1:9091", "admin API listen address, empty to disable")
+var adminToken = flag.String("admin-token", os.Getenv("WSC_ADMIN_TOKEN"), "admin API bearer token")
+var journalFilePath = flag.String("journal", "./usage.journal", "usage journal, empty to report directly")
 
 func main() {
 	flag.Parse()
@@ -54,12 +58,35 @@ func main() {
 	// }
 
 	pro := proxy.NewProxy(&CustomAuth{DB: db}, 60, time.Second*10, 1*1e6*1e4)
+	if *journalFilePath != "" {
+		if err := pro.EnableUsageJournal(*journalFilePath); err != nil {
+			ge.Throw(err)
+		}
+	}
 
 	server := &http.Server{
 		Addr:    ":4040",
 		Handler: pro,
 	}
 
+	if *metricsAddr != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", pro.MetricsHandler())
+		go func() {
+			if err := http.ListenAndServe(*metricsAddr, metricsMux); err != nil {
+				slog.Error("metrics server error", "err", err)
+			}
+		}()
+	}
+
+	if *adminAddr != "" && *adminToken != "" {
+		go func() {
+			if err := http.ListenAndServe(*adminAddr, proxy.NewAdmin(pro, *adminToken)); err != nil {
+				slog.Error("admin server error", "err", err)
+			}
+		}()
+	}
+
 	go func() {
 		slog.Info("running server on : ", slog.String("addr", server.Addr))
 		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -79,4 +106,10 @@ func main() {
 	} else {
 		slog.Info("server gracefully stopped")
 	}
+
+	if err := pro.Shutdown(shutdownCtx); err != nil {
+		slog.Error("proxy shutdown failed", "err", err)
+	} else {
+		slog.Info("proxy gracefully stopped")
+	}
 }
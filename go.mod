@@ -3,16 +3,15 @@ module github.com/b00tkitism/wsc
 go 1.24.4
 
 require (
-	github.com/firefart/gosocks v0.4.2
 	github.com/gobwas/ws v1.4.0
 	github.com/itsabgr/ge v0.0.0-20241202140951-7f5c5d99dde6
 	github.com/mattn/go-sqlite3 v1.14.28
-	goftp.io/server/v2 v2.0.1
+	golang.org/x/net v0.41.0
 	golang.org/x/sync v0.16.0
 )
 
 require (
 	github.com/gobwas/httphead v0.1.0 // indirect
 	github.com/gobwas/pool v0.2.1 // indirect
-	golang.org/x/sys v0.6.0 // indirect
+	golang.org/x/sys v0.33.0 // indirect
 )
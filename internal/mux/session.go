@@ -0,0 +1,268 @@
+package mux
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/b00tkitism/wsc/protocol"
+)
+
+var ErrSessionClosed = errors.New("mux session closed")
+
+// FrameConn carries whole mux frames. WriteFrame must be safe for concurrent
+// use since every stream writes through it.
+type FrameConn interface {
+	ReadFrame() ([]byte, error)
+	WriteFrame(data []byte) error
+	Close() error
+}
+
+type AcceptFunc func(stream *Stream, endpoint string)
+
+type Config struct {
+	MaxStreams int
+	// CloseCodes makes close frames carry a protocol.MuxClosePayload, as on
+	// Version2 sessions.
+	CloseCodes bool
+}
+
+// CloseError is what opening or using a stream fails with when the peer
+// closed it with a protocol.CloseCode.
+type CloseError struct {
+	Code   protocol.CloseCode
+	Reason string
+}
+
+func (err *CloseError) Error() string {
+	return err.Reason
+}
+
+type Session struct {
+	frameConn FrameConn
+	config    Config
+	accept    AcceptFunc
+	handlers  sync.WaitGroup
+
+	mutex   sync.Mutex
+	streams map[uint32]*Stream
+	nextID  uint32
+	err     error
+	done    chan struct{}
+}
+
+func NewServerSession(frameConn FrameConn, config Config, accept AcceptFunc) *Session {
+	session := newSession(frameConn, config)
+	session.accept = accept
+	return session
+}
+
+func NewClientSession(frameConn FrameConn, config Config) *Session {
+	session := newSession(frameConn, config)
+	go session.Serve()
+	return session
+}
+
+func newSession(frameConn FrameConn, config Config) *Session {
+	return &Session{
+		frameConn: frameConn,
+		config:    config,
+		streams:   map[uint32]*Stream{},
+		done:      make(chan struct{}),
+	}
+}
+
+func (session *Session) Serve() error {
+	frame := protocol.MuxFrame{}
+	for {
+		data, err := session.frameConn.ReadFrame()
+		if err != nil {
+			session.shutdown(err)
+			return err
+		}
+		if err := frame.UnmarshalBinaryUnsafe(data); err != nil {
+			session.shutdown(err)
+			return err
+		}
+		if err := session.handleFrame(&frame); err != nil {
+			session.shutdown(err)
+			return err
+		}
+	}
+}
+
+func (session *Session) closePayload(code protocol.CloseCode, reason string) []byte {
+	if session.config.CloseCodes {
+		return protocol.MuxClosePayload(code, reason)
+	}
+	return []byte(reason)
+}
+
+// closeError turns the payload of a close frame into the error the stream
+// fails with, nil for a plain close.
+func (session *Session) closeError(payload []byte) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	if !session.config.CloseCodes {
+		return errors.New(string(payload))
+	}
+	code, reason, err := protocol.ParseMuxClosePayload(payload)
+	if err != nil {
+		return err
+	}
+	if code == 0 {
+		return errors.New(reason)
+	}
+	return &CloseError{Code: code, Reason: reason}
+}
+
+func (session *Session) handleFrame(frame *protocol.MuxFrame) error {
+	switch frame.Type {
+	case protocol.MuxFrameOpen:
+		if session.accept == nil {
+			return errors.New("unexpected open frame")
+		}
+		session.mutex.Lock()
+		if _, exists := session.streams[frame.StreamID]; exists {
+			session.mutex.Unlock()
+			return errors.New("duplicate stream id")
+		}
+		if session.config.MaxStreams > 0 && len(session.streams) >= session.config.MaxStreams {
+			session.mutex.Unlock()
+			return session.writeFrame(protocol.MuxFrameClose, frame.StreamID, session.closePayload(0, "too many streams"))
+		}
+		stream := newStream(session, frame.StreamID, string(frame.Payload))
+		session.streams[frame.StreamID] = stream
+		session.mutex.Unlock()
+		session.handlers.Add(1)
+		go func() {
+			defer session.handlers.Done()
+			session.accept(stream, stream.endpoint)
+		}()
+	case protocol.MuxFrameOpenAck:
+		if stream := session.stream(frame.StreamID); stream != nil {
+			stream.opened(nil)
+		}
+	case protocol.MuxFrameData:
+		if stream := session.stream(frame.StreamID); stream != nil {
+			if !stream.push(frame.Payload) {
+				stream.reset("flow control violation")
+			}
+		}
+	case protocol.MuxFrameWindowUpdate:
+		increment, err := protocol.ParseMuxWindowUpdate(frame.Payload)
+		if err != nil {
+			return err
+		}
+		if stream := session.stream(frame.StreamID); stream != nil {
+			stream.addWindow(increment)
+		}
+	case protocol.MuxFrameClose:
+		if stream := session.stream(frame.StreamID); stream != nil {
+			stream.remoteClose(session.closeError(frame.Payload))
+		}
+	default:
+		return errors.New("unknown mux frame type")
+	}
+	return nil
+}
+
+func (session *Session) Open(ctx context.Context, endpoint string) (*Stream, error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return nil, session.err
+	}
+	session.nextID++
+	stream := newStream(session, session.nextID, endpoint)
+	session.streams[stream.id] = stream
+	session.mutex.Unlock()
+
+	if err := session.writeFrame(protocol.MuxFrameOpen, stream.id, []byte(endpoint)); err != nil {
+		session.removeStream(stream.id)
+		return nil, err
+	}
+
+	select {
+	case err := <-stream.openResult:
+		if err != nil {
+			return nil, err
+		}
+		return stream, nil
+	case <-ctx.Done():
+		stream.Close()
+		return nil, ctx.Err()
+	case <-session.done:
+		return nil, session.Err()
+	}
+}
+
+// Wait blocks until every AcceptFunc of a server session returned. Call it
+// once Serve returned and whatever the handlers block on is canceled.
+func (session *Session) Wait() {
+	session.handlers.Wait()
+}
+
+func (session *Session) NumStreams() int {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return len(session.streams)
+}
+
+func (session *Session) Done() <-chan struct{} {
+	return session.done
+}
+
+func (session *Session) Err() error {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.err
+}
+
+func (session *Session) Close() error {
+	session.shutdown(ErrSessionClosed)
+	return session.frameConn.Close()
+}
+
+func (session *Session) shutdown(err error) {
+	session.mutex.Lock()
+	if session.err != nil {
+		session.mutex.Unlock()
+		return
+	}
+	session.err = err
+	streams := session.streams
+	session.streams = map[uint32]*Stream{}
+	close(session.done)
+	session.mutex.Unlock()
+
+	for _, stream := range streams {
+		stream.abort(err)
+	}
+}
+
+func (session *Session) stream(id uint32) *Stream {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return session.streams[id]
+}
+
+func (session *Session) removeStream(id uint32) {
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	delete(session.streams, id)
+}
+
+func (session *Session) writeFrame(frameType protocol.MuxFrameType, id uint32, payload []byte) error {
+	frame := protocol.MuxFrame{
+		Type:     frameType,
+		StreamID: id,
+		Payload:  payload,
+	}
+	data, err := frame.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return session.frameConn.WriteFrame(data)
+}
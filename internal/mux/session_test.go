@@ -0,0 +1,280 @@
+package mux
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+)
+
+// pipeConn is one end of an in-memory FrameConn pair. Closing either end
+// closes both.
+type pipeConn struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func framePipe() (*pipeConn, *pipeConn) {
+	a, b := make(chan []byte, 1024), make(chan []byte, 1024)
+	closed, once := make(chan struct{}), &sync.Once{}
+	return &pipeConn{in: a, out: b, closed: closed, once: once}, &pipeConn{in: b, out: a, closed: closed, once: once}
+}
+
+func (conn *pipeConn) ReadFrame() ([]byte, error) {
+	select {
+	case data := <-conn.in:
+		return data, nil
+	case <-conn.closed:
+		return nil, io.EOF
+	}
+}
+
+func (conn *pipeConn) WriteFrame(data []byte) error {
+	select {
+	case conn.out <- bytes.Clone(data):
+		return nil
+	case <-conn.closed:
+		return io.ErrClosedPipe
+	}
+}
+
+func (conn *pipeConn) Close() error {
+	conn.once.Do(func() { close(conn.closed) })
+	return nil
+}
+
+func (conn *pipeConn) readFrame(t *testing.T) protocol.MuxFrame {
+	t.Helper()
+	select {
+	case data := <-conn.in:
+		frame := protocol.MuxFrame{}
+		if err := frame.UnmarshalBinary(data); err != nil {
+			t.Fatal(err)
+		}
+		return frame
+	case <-time.After(5 * time.Second):
+		t.Fatal("no frame arrived")
+		return protocol.MuxFrame{}
+	}
+}
+
+func (conn *pipeConn) writeFrame(t *testing.T, frameType protocol.MuxFrameType, id uint32, payload []byte) {
+	t.Helper()
+	data, err := (&protocol.MuxFrame{Type: frameType, StreamID: id, Payload: payload}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.WriteFrame(data); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// sessionPair connects a client session to a server session running accept.
+func sessionPair(t *testing.T, config Config, accept AcceptFunc) (*Session, *Session) {
+	t.Helper()
+	clientConn, serverConn := framePipe()
+	server := NewServerSession(serverConn, config, accept)
+	go server.Serve()
+	client := NewClientSession(clientConn, config)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		server.Wait()
+	})
+	return client, server
+}
+
+func openStream(t *testing.T, client *Session, endpoint string) *Stream {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	stream, err := client.Open(ctx, endpoint)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+	return stream
+}
+
+func TestSessionEcho(t *testing.T) {
+	endpoints := make(chan string, 1)
+	client, _ := sessionPair(t, Config{}, func(stream *Stream, endpoint string) {
+		endpoints <- endpoint
+		stream.Accept()
+		io.Copy(stream, stream)
+		stream.Close()
+	})
+
+	stream := openStream(t, client, "example.com:443")
+	if endpoint := <-endpoints; endpoint != "example.com:443" {
+		t.Errorf("server saw endpoint %q", endpoint)
+	}
+	message := bytes.Repeat([]byte("wsc"), protocol.MuxMaxDataPayload)
+	go stream.Write(message)
+	echoed := make([]byte, len(message))
+	if _, err := io.ReadFull(stream, echoed); err != nil || !bytes.Equal(echoed, message) {
+		t.Fatalf("echo failed: %v", err)
+	}
+
+	stream.Close()
+	if _, err := stream.Read(make([]byte, 1)); err == nil {
+		t.Error("Read after Close succeeded")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for client.NumStreams() != 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := client.NumStreams(); n != 0 {
+		t.Errorf("client still tracks %d streams", n)
+	}
+}
+
+func TestSessionReject(t *testing.T) {
+	tests := []struct {
+		name       string
+		closeCodes bool
+		code       protocol.CloseCode
+		wantCode   protocol.CloseCode
+	}{
+		{"plain reason", false, protocol.CloseDialRefused, 0},
+		{"close code", true, protocol.CloseDialRefused, protocol.CloseDialRefused},
+		{"no close code", true, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client, _ := sessionPair(t, Config{CloseCodes: test.closeCodes}, func(stream *Stream, endpoint string) {
+				stream.Reject(test.code, "refused")
+			})
+
+			_, err := client.Open(context.Background(), "10.0.0.1:22")
+			if err == nil {
+				t.Fatal("Open of a rejected stream succeeded")
+			}
+			closeErr := &CloseError{}
+			if errors.As(err, &closeErr) != (test.wantCode != 0) || err.Error() != "refused" {
+				t.Fatalf("Open = %#v, want code %d and reason \"refused\"", err, test.wantCode)
+			}
+			if test.wantCode != 0 && closeErr.Code != test.wantCode {
+				t.Errorf("close code %d, want %d", closeErr.Code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestSessionMaxStreams(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	client, _ := sessionPair(t, Config{MaxStreams: 1}, func(stream *Stream, endpoint string) {
+		stream.Accept()
+		<-release
+	})
+
+	openStream(t, client, "a:1")
+	if _, err := client.Open(context.Background(), "b:1"); err == nil || err.Error() != "too many streams" {
+		t.Errorf("second Open = %v, want too many streams", err)
+	}
+}
+
+func TestStreamFlowControl(t *testing.T) {
+	server := make(chan *Stream, 1)
+	client, _ := sessionPair(t, Config{}, func(stream *Stream, endpoint string) {
+		stream.Accept()
+		server <- stream
+		<-stream.session.Done()
+	})
+	stream := openStream(t, client, "a:1")
+	remote := <-server
+
+	// Nobody reads, so the writer stalls once the initial window is used up.
+	stream.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	n, err := stream.Write(make([]byte, protocol.MuxInitialWindow+10))
+	if n != protocol.MuxInitialWindow || !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Write = %d, %v, want %d and a deadline error", n, err, protocol.MuxInitialWindow)
+	}
+
+	// Reading half the window hands it back to the writer.
+	if _, err := io.ReadFull(remote, make([]byte, protocol.MuxInitialWindow/2)); err != nil {
+		t.Fatal(err)
+	}
+	stream.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if n, err := stream.Write(make([]byte, protocol.MuxInitialWindow/2)); err != nil {
+		t.Errorf("Write after a window update = %d, %v", n, err)
+	}
+}
+
+func TestStreamWindowViolation(t *testing.T) {
+	peer, serverConn := framePipe()
+	accepted := make(chan *Stream, 1)
+	server := NewServerSession(serverConn, Config{}, func(stream *Stream, endpoint string) {
+		stream.Accept()
+		accepted <- stream
+	})
+	go server.Serve()
+	defer server.Close()
+
+	peer.writeFrame(t, protocol.MuxFrameOpen, 1, []byte("a:1"))
+	if frame := peer.readFrame(t); frame.Type != protocol.MuxFrameOpenAck {
+		t.Fatalf("got frame type %d, want an open ack", frame.Type)
+	}
+	stream := <-accepted
+
+	chunk := make([]byte, protocol.MuxMaxDataPayload)
+	for range protocol.MuxInitialWindow/protocol.MuxMaxDataPayload + 1 {
+		peer.writeFrame(t, protocol.MuxFrameData, 1, chunk)
+	}
+	frame := peer.readFrame(t)
+	if frame.Type != protocol.MuxFrameClose || frame.StreamID != 1 || string(frame.Payload) != "flow control violation" {
+		t.Fatalf("got frame type %d %q, want a flow control reset", frame.Type, frame.Payload)
+	}
+
+	// What fit in the window is still readable, then the reset surfaces.
+	n, err := io.Copy(io.Discard, stream)
+	if n != protocol.MuxInitialWindow || err == nil || err.Error() != "flow control violation" {
+		t.Errorf("stream read %d bytes then %v", n, err)
+	}
+}
+
+func TestSessionCloseAbortsStreams(t *testing.T) {
+	client, server := sessionPair(t, Config{}, func(stream *Stream, endpoint string) {
+		stream.Accept()
+		io.Copy(io.Discard, stream)
+	})
+	stream := openStream(t, client, "a:1")
+
+	readErr := make(chan error, 1)
+	go func() {
+		_, err := stream.Read(make([]byte, 1))
+		readErr <- err
+	}()
+	client.Close()
+
+	select {
+	case err := <-readErr:
+		if !errors.Is(err, ErrSessionClosed) {
+			t.Errorf("blocked Read = %v, want ErrSessionClosed", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close didn't wake a blocked Read")
+	}
+	if _, err := stream.Write([]byte("x")); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Write after Close = %v, want ErrSessionClosed", err)
+	}
+	if _, err := client.Open(context.Background(), "b:1"); !errors.Is(err, ErrSessionClosed) {
+		t.Errorf("Open after Close = %v, want ErrSessionClosed", err)
+	}
+
+	select {
+	case <-server.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("server session outlived the connection")
+	}
+	server.Wait()
+}
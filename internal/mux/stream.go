@@ -0,0 +1,297 @@
+package mux
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+)
+
+var _ net.Conn = &Stream{}
+
+type Stream struct {
+	session  *Session
+	id       uint32
+	endpoint string
+
+	openResult chan error
+
+	mutex         sync.Mutex
+	cond          *sync.Cond
+	readBuf       []byte
+	consumed      uint32
+	sendWindow    uint32
+	remoteClosed  bool
+	localClosed   bool
+	err           error
+	readDeadline  time.Time
+	writeDeadline time.Time
+	readTimer     *time.Timer
+	writeTimer    *time.Timer
+}
+
+func newStream(session *Session, id uint32, endpoint string) *Stream {
+	stream := &Stream{
+		session:    session,
+		id:         id,
+		endpoint:   endpoint,
+		openResult: make(chan error, 1),
+		sendWindow: protocol.MuxInitialWindow,
+	}
+	stream.cond = sync.NewCond(&stream.mutex)
+	return stream
+}
+
+func (stream *Stream) ID() uint32 {
+	return stream.id
+}
+
+func (stream *Stream) Endpoint() string {
+	return stream.endpoint
+}
+
+func (stream *Stream) Accept() error {
+	return stream.session.writeFrame(protocol.MuxFrameOpenAck, stream.id, nil)
+}
+
+// Reject refuses the stream. code may be zero when no protocol.CloseCode
+// applies, and is dropped on sessions without Config.CloseCodes.
+func (stream *Stream) Reject(code protocol.CloseCode, reason string) error {
+	stream.mutex.Lock()
+	stream.localClosed = true
+	stream.remoteClosed = true
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+	stream.session.removeStream(stream.id)
+	return stream.session.writeFrame(protocol.MuxFrameClose, stream.id, stream.session.closePayload(code, reason))
+}
+
+func (stream *Stream) Read(p []byte) (int, error) {
+	stream.mutex.Lock()
+	for len(stream.readBuf) == 0 {
+		switch {
+		case stream.localClosed:
+			stream.mutex.Unlock()
+			return 0, net.ErrClosed
+		case stream.err != nil:
+			stream.mutex.Unlock()
+			return 0, stream.err
+		case stream.remoteClosed:
+			stream.mutex.Unlock()
+			return 0, io.EOF
+		case deadlineExceeded(stream.readDeadline):
+			stream.mutex.Unlock()
+			return 0, os.ErrDeadlineExceeded
+		}
+		stream.cond.Wait()
+	}
+
+	n := copy(p, stream.readBuf)
+	stream.readBuf = stream.readBuf[n:]
+	stream.consumed += uint32(n)
+	var increment uint32
+	if stream.consumed >= protocol.MuxInitialWindow/2 {
+		increment = stream.consumed
+		stream.consumed = 0
+	}
+	remoteClosed := stream.remoteClosed
+	stream.mutex.Unlock()
+
+	if increment > 0 && !remoteClosed {
+		if err := stream.session.writeFrame(protocol.MuxFrameWindowUpdate, stream.id, protocol.MuxWindowUpdatePayload(increment)); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (stream *Stream) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		stream.mutex.Lock()
+		for stream.sendWindow == 0 {
+			if err := stream.writeErr(); err != nil {
+				stream.mutex.Unlock()
+				return written, err
+			}
+			stream.cond.Wait()
+		}
+		if err := stream.writeErr(); err != nil {
+			stream.mutex.Unlock()
+			return written, err
+		}
+		chunk := min(len(p)-written, int(stream.sendWindow), protocol.MuxMaxDataPayload)
+		stream.sendWindow -= uint32(chunk)
+		stream.mutex.Unlock()
+
+		if err := stream.session.writeFrame(protocol.MuxFrameData, stream.id, p[written:written+chunk]); err != nil {
+			return written, err
+		}
+		written += chunk
+	}
+	return written, nil
+}
+
+func (stream *Stream) writeErr() error {
+	switch {
+	case stream.localClosed:
+		return net.ErrClosed
+	case stream.err != nil:
+		return stream.err
+	case stream.remoteClosed:
+		return io.ErrClosedPipe
+	case deadlineExceeded(stream.writeDeadline):
+		return os.ErrDeadlineExceeded
+	}
+	return nil
+}
+
+func (stream *Stream) Close() error {
+	stream.mutex.Lock()
+	if stream.localClosed {
+		stream.mutex.Unlock()
+		return nil
+	}
+	stream.localClosed = true
+	notify := !stream.remoteClosed && stream.err == nil
+	stream.stopTimers()
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	stream.session.removeStream(stream.id)
+	if notify {
+		return stream.session.writeFrame(protocol.MuxFrameClose, stream.id, nil)
+	}
+	return nil
+}
+
+func (stream *Stream) LocalAddr() net.Addr {
+	return &net.TCPAddr{}
+}
+
+func (stream *Stream) RemoteAddr() net.Addr {
+	return streamAddr(stream.endpoint)
+}
+
+func (stream *Stream) SetDeadline(t time.Time) error {
+	if err := stream.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return stream.SetWriteDeadline(t)
+}
+
+func (stream *Stream) SetReadDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.readDeadline = t
+	stream.readTimer = stream.armTimer(stream.readTimer, t)
+	return nil
+}
+
+func (stream *Stream) SetWriteDeadline(t time.Time) error {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.writeDeadline = t
+	stream.writeTimer = stream.armTimer(stream.writeTimer, t)
+	return nil
+}
+
+func (stream *Stream) armTimer(timer *time.Timer, t time.Time) *time.Timer {
+	if timer != nil {
+		timer.Stop()
+	}
+	stream.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		stream.mutex.Lock()
+		stream.cond.Broadcast()
+		stream.mutex.Unlock()
+	})
+}
+
+func (stream *Stream) stopTimers() {
+	if stream.readTimer != nil {
+		stream.readTimer.Stop()
+	}
+	if stream.writeTimer != nil {
+		stream.writeTimer.Stop()
+	}
+}
+
+func (stream *Stream) opened(err error) {
+	select {
+	case stream.openResult <- err:
+	default:
+	}
+}
+
+func (stream *Stream) push(data []byte) bool {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.localClosed {
+		return true
+	}
+	if len(stream.readBuf)+len(data) > protocol.MuxInitialWindow {
+		return false
+	}
+	stream.readBuf = append(stream.readBuf, data...)
+	stream.cond.Broadcast()
+	return true
+}
+
+func (stream *Stream) addWindow(increment uint32) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	stream.sendWindow += increment
+	stream.cond.Broadcast()
+}
+
+func (stream *Stream) remoteClose(err error) {
+	stream.mutex.Lock()
+	stream.remoteClosed = true
+	stream.cond.Broadcast()
+	stream.mutex.Unlock()
+
+	stream.session.removeStream(stream.id)
+	if err == nil {
+		stream.opened(io.EOF)
+	} else {
+		stream.opened(err)
+	}
+}
+
+func (stream *Stream) reset(reason string) {
+	stream.abort(errors.New(reason))
+	stream.session.removeStream(stream.id)
+	stream.session.writeFrame(protocol.MuxFrameClose, stream.id, stream.session.closePayload(0, reason))
+}
+
+func (stream *Stream) abort(err error) {
+	stream.mutex.Lock()
+	defer stream.mutex.Unlock()
+	if stream.err == nil {
+		stream.err = err
+	}
+	stream.cond.Broadcast()
+	stream.opened(err)
+}
+
+func deadlineExceeded(deadline time.Time) bool {
+	return !deadline.IsZero() && !time.Now().Before(deadline)
+}
+
+type streamAddr string
+
+func (addr streamAddr) Network() string {
+	return "tcp"
+}
+
+func (addr streamAddr) String() string {
+	return string(addr)
+}
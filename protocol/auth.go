@@ -0,0 +1,37 @@
+package protocol
+
+import (
+	"encoding/base64"
+	"errors"
+	"strings"
+)
+
+const (
+	// Subprotocol is the WebSocket subprotocol the server selects unless the
+	// client offers a VersionSubprotocol first. Clients sending the token as a
+	// subprotocol must offer one of them too, so the token is never echoed
+	// back in the handshake response.
+	Subprotocol = "wsc"
+
+	AuthSubprotocolPrefix = "wsc-auth."
+	AuthCookieName        = "wsc_auth"
+	AuthQueryParam        = "auth"
+)
+
+// AuthSubprotocol encodes token as a Sec-WebSocket-Protocol value. Tokens are
+// base64url encoded because subprotocols must be valid HTTP tokens.
+func AuthSubprotocol(token string) string {
+	return AuthSubprotocolPrefix + base64.RawURLEncoding.EncodeToString([]byte(token))
+}
+
+func ParseAuthSubprotocol(value string) (string, error) {
+	encoded, ok := strings.CutPrefix(value, AuthSubprotocolPrefix)
+	if !ok {
+		return "", errors.New("not an auth subprotocol: " + value)
+	}
+	token, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
@@ -0,0 +1,40 @@
+package protocol
+
+import "strconv"
+
+// CloseCode is the status code of the close frame the proxy ends a tunnel
+// with. The codes below live in the 4000-4999 range RFC 6455 leaves to
+// applications.
+type CloseCode uint16
+
+const (
+	CloseDialRefused CloseCode = 4000 + iota
+	CloseDNSFailure
+	CloseHostUnreachable
+	ClosePolicyDenied
+	CloseQuotaExceeded
+	CloseEvicted
+	CloseServerShutdown
+)
+
+// CloseCodeHeader is set on an upgrade the proxy accepts only to refuse the
+// tunnel. A close frame with the same code and the reason follows right away.
+const CloseCodeHeader = "Wsc-Close-Code"
+
+var closeCodeNames = map[CloseCode]string{
+	CloseDialRefused:     "dial refused",
+	CloseDNSFailure:      "dns failure",
+	CloseHostUnreachable: "host unreachable",
+	ClosePolicyDenied:    "policy denied",
+	CloseQuotaExceeded:   "quota exceeded",
+	CloseEvicted:         "evicted by newer connection",
+	CloseServerShutdown:  "server shutdown",
+}
+
+// String is the default reason sent along with code.
+func (code CloseCode) String() string {
+	if name, ok := closeCodeNames[code]; ok {
+		return name
+	}
+	return "close code " + strconv.Itoa(int(code))
+}
@@ -0,0 +1,6 @@
+package protocol
+
+// HalfCloseMessage is sent as a text message on a TCP tunnel that negotiated
+// CapHalfClose once the sender won't write anymore, like a TCP FIN. The peer
+// keeps sending until it's done too. Data always travels in binary messages.
+const HalfCloseMessage = "fin"
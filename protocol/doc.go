@@ -0,0 +1,51 @@
+// Package protocol defines the wsc wire format shared by the client and the
+// proxy.
+//
+// # Handshake
+//
+// A tunnel is a WebSocket upgrade. The query string carries net (tcp, udp or
+// mux, tcp when missing) and ep, the host:port to connect to, which mux
+// tunnels omit. The auth token travels as described in auth.go.
+//
+// Clients announce the highest version they speak either with the v query
+// parameter or by offering VersionSubprotocol before Subprotocol, and list
+// the capabilities they want in caps. The server answers with the version it
+// picked in the VersionHeader response header and the granted capabilities
+// in CapabilitiesHeader. Requests without a version are served as Version1.
+//
+// There is deliberately no compression capability. Tunnels mostly carry TLS,
+// which doesn't compress, and compressing attacker-influenced bytes next to
+// secrets leaks them the way CRIME and BREACH do. A client asking for
+// "compression" has it ignored like any other unknown capability name.
+//
+// # Version 1
+//
+// TCP tunnels carry the stream in binary messages. UDP tunnels carry one
+// PacketConnPayload per message: a 16-byte address (IPv4 in mapped form), a
+// little-endian port and the datagram. Mux tunnels carry one MuxFrame per
+// message.
+//
+// # Version 2
+//
+// Like Version1, except UDP tunnels carry one PacketFrame per message, with a
+// typed address and a big-endian port like every other field. Domain targets
+// need CapUDPDomain.
+//
+// Mux close frames with a payload carry a MuxClosePayload instead of a bare
+// reason, so a refused stream says why with a CloseCode.
+//
+// With CapHalfClose, either side of a TCP tunnel may send HalfCloseMessage in
+// a text message to shut down its direction while the other keeps flowing.
+//
+// A Version2 server dials the target of tcp and udp tunnels before the
+// upgrade, so a completed upgrade means the tunnel is connected. When it
+// refuses a tunnel, it still upgrades, sets CloseCodeHeader and sends a close
+// frame with one of the CloseCode values and a reason. Version1 clients get a
+// plain HTTP error instead.
+//
+// # Close codes
+//
+// Tunnels of any version the server ends on its own, because the user ran out
+// of quota, a newer connection evicted it or the server shuts down, get a
+// close frame with the matching CloseCode.
+package protocol
@@ -0,0 +1,101 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+)
+
+const MuxFrameHeaderLen = 5
+
+// MuxMaxDataPayload bounds a single data frame so one stream can't hog the
+// shared WebSocket for long.
+const MuxMaxDataPayload = 16 * 1024
+
+const MuxInitialWindow = 256 * 1024
+
+type MuxFrameType byte
+
+const (
+	MuxFrameOpen MuxFrameType = iota + 1
+	MuxFrameOpenAck
+	MuxFrameData
+	MuxFrameClose
+	MuxFrameWindowUpdate
+)
+
+var _ encoding.BinaryMarshaler = &MuxFrame{}
+var _ encoding.BinaryUnmarshaler = &MuxFrame{}
+
+type MuxFrame struct {
+	Type     MuxFrameType
+	StreamID uint32
+	Payload  []byte
+}
+
+func (frame *MuxFrame) UnmarshalBinary(data []byte) error {
+	if err := frame.UnmarshalBinaryUnsafe(data); err != nil {
+		return err
+	}
+
+	frame.Payload = append(make([]byte, 0, len(frame.Payload)), frame.Payload...)
+
+	return nil
+}
+
+func (frame *MuxFrame) MarshalBinary() (data []byte, err error) {
+	data = make([]byte, len(frame.Payload)+MuxFrameHeaderLen)
+	return data, frame.MarshalBinaryUnsafe(data)
+}
+
+func (frame *MuxFrame) UnmarshalBinaryUnsafe(data []byte) error {
+	const hLen = MuxFrameHeaderLen
+
+	if len(data) < hLen {
+		return errors.New("invalid mux frame")
+	}
+
+	frame.Type = MuxFrameType(data[0])
+	frame.StreamID = binary.BigEndian.Uint32(data[1:hLen])
+	frame.Payload = data[hLen:]
+
+	return nil
+}
+
+func (frame *MuxFrame) MarshalBinaryUnsafe(data []byte) error {
+	const hLen = MuxFrameHeaderLen
+
+	if len(data) < hLen+len(frame.Payload) {
+		return errors.New("invalid data length to write")
+	}
+
+	data[0] = byte(frame.Type)
+	binary.BigEndian.PutUint32(data[1:hLen], frame.StreamID)
+	copy(data[hLen:], frame.Payload)
+
+	return nil
+}
+
+func MuxWindowUpdatePayload(increment uint32) []byte {
+	return binary.BigEndian.AppendUint32(nil, increment)
+}
+
+func ParseMuxWindowUpdate(payload []byte) (uint32, error) {
+	if len(payload) != 4 {
+		return 0, errors.New("invalid window update")
+	}
+	return binary.BigEndian.Uint32(payload), nil
+}
+
+// MuxClosePayload is the payload of a close frame on a Version2 session: a
+// big-endian CloseCode, zero when none applies, followed by the reason.
+func MuxClosePayload(code CloseCode, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, uint16(code)), reason...)
+}
+
+func ParseMuxClosePayload(payload []byte) (CloseCode, string, error) {
+	if len(payload) < 2 {
+		return 0, "", errors.New("invalid close payload")
+	}
+	return CloseCode(binary.BigEndian.Uint16(payload)), string(payload[2:]), nil
+}
@@ -0,0 +1,71 @@
+package protocol
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestMuxFrameRoundTrip(t *testing.T) {
+	tests := []MuxFrame{
+		{Type: MuxFrameOpen, StreamID: 1, Payload: []byte("example.com:443")},
+		{Type: MuxFrameOpenAck, StreamID: 1},
+		{Type: MuxFrameData, StreamID: 0xfffffffe, Payload: bytes.Repeat([]byte{0xab}, MuxMaxDataPayload)},
+		{Type: MuxFrameClose, StreamID: 7, Payload: MuxClosePayload(CloseDialRefused, "refused")},
+		{Type: MuxFrameWindowUpdate, StreamID: 3, Payload: MuxWindowUpdatePayload(MuxInitialWindow)},
+	}
+
+	for _, frame := range tests {
+		data, err := frame.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%d): %v", frame.Type, err)
+		}
+		if len(data) != MuxFrameHeaderLen+len(frame.Payload) {
+			t.Errorf("MarshalBinary(%d) encoded %d bytes", frame.Type, len(data))
+		}
+
+		got := MuxFrame{}
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary(%d): %v", frame.Type, err)
+		}
+		if got.Type != frame.Type || got.StreamID != frame.StreamID || !bytes.Equal(got.Payload, frame.Payload) {
+			t.Errorf("decoded type %d stream %d, want type %d stream %d", got.Type, got.StreamID, frame.Type, frame.StreamID)
+		}
+	}
+
+	if err := (&MuxFrame{}).UnmarshalBinary(make([]byte, MuxFrameHeaderLen-1)); err == nil {
+		t.Error("UnmarshalBinary of a short frame succeeded")
+	}
+}
+
+func TestMuxWindowUpdate(t *testing.T) {
+	increment, err := ParseMuxWindowUpdate(MuxWindowUpdatePayload(123456))
+	if err != nil || increment != 123456 {
+		t.Errorf("ParseMuxWindowUpdate = %d, %v, want 123456", increment, err)
+	}
+	for _, payload := range [][]byte{nil, {1, 2, 3}, {1, 2, 3, 4, 5}} {
+		if _, err := ParseMuxWindowUpdate(payload); err == nil {
+			t.Errorf("ParseMuxWindowUpdate(%v) succeeded", payload)
+		}
+	}
+}
+
+func TestMuxClosePayload(t *testing.T) {
+	tests := []struct {
+		code   CloseCode
+		reason string
+	}{
+		{CloseDialRefused, "connection refused"},
+		{ClosePolicyDenied, ""},
+		{0, "too many streams"},
+	}
+
+	for _, test := range tests {
+		code, reason, err := ParseMuxClosePayload(MuxClosePayload(test.code, test.reason))
+		if err != nil || code != test.code || reason != test.reason {
+			t.Errorf("ParseMuxClosePayload = %d %q %v, want %d %q", code, reason, err, test.code, test.reason)
+		}
+	}
+	if _, _, err := ParseMuxClosePayload([]byte{0x0f}); err == nil {
+		t.Error("ParseMuxClosePayload of one byte succeeded")
+	}
+}
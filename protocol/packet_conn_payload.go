@@ -0,0 +1,76 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net/netip"
+)
+
+const PacketConnPayloadHeaderLen = 18
+
+var _ encoding.BinaryMarshaler = &PacketConnPayload{}
+var _ encoding.BinaryUnmarshaler = &PacketConnPayload{}
+
+type PacketConnPayload struct {
+	AddrPort netip.AddrPort
+	Payload  []byte
+}
+
+func (payload *PacketConnPayload) UnmarshalBinary(data []byte) error {
+	if err := payload.UnmarshalBinaryUnsafe(data); err != nil {
+		return err
+	}
+
+	payload.Payload = append(make([]byte, 0, len(payload.Payload)), payload.Payload...)
+
+	return nil
+}
+
+func (payload *PacketConnPayload) MarshalBinary() (data []byte, err error) {
+	if !payload.AddrPort.IsValid() {
+		return nil, errors.New("addr port is not valid")
+	}
+	data = make([]byte, len(payload.Payload)+PacketConnPayloadHeaderLen)
+	return data, payload.MarshalBinaryUnsafe(data)
+}
+
+func (payload *PacketConnPayload) UnmarshalBinaryUnsafe(data []byte) error {
+	const hLen = PacketConnPayloadHeaderLen
+
+	if len(data) < hLen {
+		return errors.New("invalid payload")
+	}
+
+	addr, ok := netip.AddrFromSlice(data[:hLen-2])
+	if !ok {
+		return errors.New("couldn't parse addr port")
+	}
+	port := binary.LittleEndian.Uint16(data[hLen-2 : hLen])
+	payload.AddrPort = netip.AddrPortFrom(addr, port)
+
+	payload.Payload = data[hLen:]
+
+	return nil
+}
+
+func (payload *PacketConnPayload) MarshalBinaryUnsafe(data []byte) error {
+	const hLen = PacketConnPayloadHeaderLen
+
+	if !payload.AddrPort.IsValid() {
+		return errors.New("addr port is not valid")
+	}
+
+	if len(data) < hLen+len(payload.Payload) {
+		return errors.New("invalid data length to write")
+	}
+
+	addr := payload.AddrPort.Addr().As16()
+	copy(data[:hLen-2], addr[:])
+
+	binary.LittleEndian.PutUint16(data[hLen-2:hLen], payload.AddrPort.Port())
+
+	copy(data[hLen:], payload.Payload)
+
+	return nil
+}
@@ -0,0 +1,57 @@
+package protocol
+
+import (
+	"bytes"
+	"net/netip"
+	"testing"
+)
+
+func TestPacketConnPayloadRoundTrip(t *testing.T) {
+	tests := []struct {
+		addrPort string
+		want     string
+	}{
+		{"1.2.3.4:53", "[::ffff:1.2.3.4]:53"},
+		{"[2001:db8::1]:443", "[2001:db8::1]:443"},
+		{"[::ffff:10.0.0.1]:65535", "[::ffff:10.0.0.1]:65535"},
+	}
+
+	for _, test := range tests {
+		payload := PacketConnPayload{AddrPort: netip.MustParseAddrPort(test.addrPort), Payload: []byte("datagram")}
+		data, err := payload.MarshalBinary()
+		if err != nil {
+			t.Fatalf("MarshalBinary(%s): %v", test.addrPort, err)
+		}
+		if len(data) != PacketConnPayloadHeaderLen+len(payload.Payload) {
+			t.Errorf("MarshalBinary(%s) encoded %d bytes", test.addrPort, len(data))
+		}
+
+		got := PacketConnPayload{}
+		if err := got.UnmarshalBinary(data); err != nil {
+			t.Fatalf("UnmarshalBinary(%s): %v", test.addrPort, err)
+		}
+		if got.AddrPort.String() != test.want || !bytes.Equal(got.Payload, payload.Payload) {
+			t.Errorf("decoded %s %q, want %s %q", got.AddrPort, got.Payload, test.want, payload.Payload)
+		}
+	}
+}
+
+func TestPacketConnPayloadPortIsLittleEndian(t *testing.T) {
+	payload := PacketConnPayload{AddrPort: netip.MustParseAddrPort("1.2.3.4:258")}
+	data, err := payload.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data[16] != 2 || data[17] != 1 {
+		t.Errorf("port encoded as %v, want [2 1]", data[16:18])
+	}
+}
+
+func TestPacketConnPayloadInvalid(t *testing.T) {
+	if err := (&PacketConnPayload{}).UnmarshalBinary(make([]byte, PacketConnPayloadHeaderLen-1)); err == nil {
+		t.Error("UnmarshalBinary of a short payload succeeded")
+	}
+	if _, err := (&PacketConnPayload{Payload: []byte("x")}).MarshalBinary(); err == nil {
+		t.Error("MarshalBinary without an address succeeded")
+	}
+}
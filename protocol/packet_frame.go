@@ -0,0 +1,162 @@
+package protocol
+
+import (
+	"encoding"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"strconv"
+)
+
+// PacketFrameVersion is the first byte of every PacketFrame, so the frame
+// layout can change without a new protocol version.
+const PacketFrameVersion = 1
+
+// Address types, numbered like SOCKS5.
+const (
+	AddrTypeIPv4   byte = 1
+	AddrTypeDomain byte = 3
+	AddrTypeIPv6   byte = 4
+)
+
+// PacketFrameMaxHeaderLen is the header of a frame naming a 255-byte domain.
+const PacketFrameMaxHeaderLen = 5 + 255
+
+var _ encoding.BinaryMarshaler = &PacketFrame{}
+var _ encoding.BinaryUnmarshaler = &PacketFrame{}
+
+// PacketFrame carries one UDP datagram as
+//
+//	version(1) | address type(1) | address | port(2, big endian) | payload
+//
+// where the address is 4 or 16 bytes for IPs and a length byte followed by the
+// name for domains. Domain is set instead of Addr for domain targets.
+type PacketFrame struct {
+	Addr    netip.Addr
+	Domain  string
+	Port    uint16
+	Payload []byte
+}
+
+// Host returns the target as "host:port".
+func (frame *PacketFrame) Host() string {
+	if frame.Domain != "" {
+		return net.JoinHostPort(frame.Domain, strconv.Itoa(int(frame.Port)))
+	}
+	return netip.AddrPortFrom(frame.Addr, frame.Port).String()
+}
+
+func (frame *PacketFrame) HeaderLen() int {
+	switch {
+	case frame.Domain != "":
+		return 5 + len(frame.Domain)
+	case frame.Addr.Unmap().Is4():
+		return 8
+	default:
+		return 20
+	}
+}
+
+func (frame *PacketFrame) UnmarshalBinary(data []byte) error {
+	if err := frame.UnmarshalBinaryUnsafe(data); err != nil {
+		return err
+	}
+
+	frame.Payload = append(make([]byte, 0, len(frame.Payload)), frame.Payload...)
+
+	return nil
+}
+
+func (frame *PacketFrame) MarshalBinary() (data []byte, err error) {
+	if err := frame.validate(); err != nil {
+		return nil, err
+	}
+	data = make([]byte, frame.HeaderLen()+len(frame.Payload))
+	return data, frame.MarshalBinaryUnsafe(data)
+}
+
+func (frame *PacketFrame) UnmarshalBinaryUnsafe(data []byte) error {
+	if len(data) < 2 {
+		return errors.New("invalid packet frame")
+	}
+	if data[0] != PacketFrameVersion {
+		return errors.New("unsupported packet frame version: " + strconv.Itoa(int(data[0])))
+	}
+
+	frame.Domain = ""
+	frame.Addr = netip.Addr{}
+	var rest []byte
+	switch data[1] {
+	case AddrTypeIPv4:
+		if len(data) < 8 {
+			return errors.New("invalid packet frame")
+		}
+		frame.Addr = netip.AddrFrom4([4]byte(data[2:6]))
+		rest = data[6:]
+	case AddrTypeIPv6:
+		if len(data) < 20 {
+			return errors.New("invalid packet frame")
+		}
+		frame.Addr = netip.AddrFrom16([16]byte(data[2:18]))
+		rest = data[18:]
+	case AddrTypeDomain:
+		if len(data) < 3 || data[2] == 0 || len(data) < 5+int(data[2]) {
+			return errors.New("invalid packet frame")
+		}
+		end := 3 + int(data[2])
+		frame.Domain = string(data[3:end])
+		rest = data[end:]
+	default:
+		return errors.New("unsupported address type: " + strconv.Itoa(int(data[1])))
+	}
+
+	frame.Port = binary.BigEndian.Uint16(rest[:2])
+	frame.Payload = rest[2:]
+
+	return nil
+}
+
+func (frame *PacketFrame) MarshalBinaryUnsafe(data []byte) error {
+	if err := frame.validate(); err != nil {
+		return err
+	}
+
+	hLen := frame.HeaderLen()
+	if len(data) < hLen+len(frame.Payload) {
+		return errors.New("invalid data length to write")
+	}
+
+	data[0] = PacketFrameVersion
+	switch {
+	case frame.Domain != "":
+		data[1] = AddrTypeDomain
+		data[2] = byte(len(frame.Domain))
+		copy(data[3:], frame.Domain)
+	case frame.Addr.Unmap().Is4():
+		data[1] = AddrTypeIPv4
+		addr := frame.Addr.Unmap().As4()
+		copy(data[2:], addr[:])
+	default:
+		data[1] = AddrTypeIPv6
+		addr := frame.Addr.As16()
+		copy(data[2:], addr[:])
+	}
+	binary.BigEndian.PutUint16(data[hLen-2:hLen], frame.Port)
+	copy(data[hLen:], frame.Payload)
+
+	return nil
+}
+
+func (frame *PacketFrame) validate() error {
+	if frame.Domain != "" {
+		if len(frame.Domain) > 255 {
+			return errors.New("domain is too long")
+		}
+		return nil
+	}
+	if !frame.Addr.IsValid() {
+		return errors.New("addr is not valid")
+	}
+	return nil
+}
@@ -0,0 +1,80 @@
+package protocol
+
+import (
+	"bytes"
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func TestPacketFrameRoundTrip(t *testing.T) {
+	tests := []struct {
+		name      string
+		frame     PacketFrame
+		headerLen int
+		want      PacketFrame
+	}{
+		{"ipv4", PacketFrame{Addr: netip.MustParseAddr("1.2.3.4"), Port: 53, Payload: []byte("query")}, 8, PacketFrame{}},
+		{"mapped ipv4", PacketFrame{Addr: netip.MustParseAddr("::ffff:1.2.3.4"), Port: 53, Payload: []byte("query")}, 8,
+			PacketFrame{Addr: netip.MustParseAddr("1.2.3.4"), Port: 53, Payload: []byte("query")}},
+		{"ipv6", PacketFrame{Addr: netip.MustParseAddr("2001:db8::1"), Port: 443, Payload: []byte{0, 1, 2}}, 20, PacketFrame{}},
+		{"domain", PacketFrame{Domain: "example.com", Port: 65535, Payload: []byte("x")}, 16, PacketFrame{}},
+		{"longest domain", PacketFrame{Domain: strings.Repeat("a", 255), Port: 1}, PacketFrameMaxHeaderLen, PacketFrame{}},
+		{"empty payload", PacketFrame{Addr: netip.MustParseAddr("10.0.0.1"), Port: 7}, 8, PacketFrame{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			want := test.want
+			if !want.Addr.IsValid() && want.Domain == "" {
+				want = test.frame
+			}
+
+			data, err := test.frame.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary: %v", err)
+			}
+			if len(data) != test.headerLen+len(test.frame.Payload) {
+				t.Errorf("encoded %d bytes, want %d", len(data), test.headerLen+len(test.frame.Payload))
+			}
+
+			got := PacketFrame{}
+			if err := got.UnmarshalBinary(data); err != nil {
+				t.Fatalf("UnmarshalBinary: %v", err)
+			}
+			if got.Addr != want.Addr || got.Domain != want.Domain || got.Port != want.Port || !bytes.Equal(got.Payload, want.Payload) {
+				t.Errorf("decoded %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestPacketFrameInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"version", []byte{2, AddrTypeIPv4, 1, 2, 3, 4, 0, 53}},
+		{"address type", []byte{PacketFrameVersion, 2, 1, 2, 3, 4, 0, 53}},
+		{"short ipv4", []byte{PacketFrameVersion, AddrTypeIPv4, 1, 2, 3, 4, 0}},
+		{"short ipv6", []byte{PacketFrameVersion, AddrTypeIPv6, 1, 2, 3, 4, 0, 53}},
+		{"empty domain", []byte{PacketFrameVersion, AddrTypeDomain, 0, 0, 53}},
+		{"short domain", []byte{PacketFrameVersion, AddrTypeDomain, 3, 'a', 'b', 0, 53}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := PacketFrame{}
+			if err := frame.UnmarshalBinary(test.data); err == nil {
+				t.Errorf("UnmarshalBinary(%v) = %+v, want error", test.data, frame)
+			}
+		})
+	}
+
+	for _, frame := range []PacketFrame{{Port: 53}, {Domain: strings.Repeat("a", 256), Port: 53}} {
+		if _, err := frame.MarshalBinary(); err == nil {
+			t.Errorf("MarshalBinary(%+v) succeeded, want error", frame)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package protocol
+
+import (
+	"strconv"
+	"strings"
+)
+
+const (
+	Version1 = 1
+	Version2 = 2
+
+	// LatestVersion is the highest version this package implements.
+	LatestVersion = Version2
+)
+
+const (
+	NetworkQueryParam      = "net"
+	EndpointQueryParam     = "ep"
+	VersionQueryParam      = "v"
+	CapabilitiesQueryParam = "caps"
+
+	VersionHeader      = "Wsc-Version"
+	CapabilitiesHeader = "Wsc-Capabilities"
+
+	VersionSubprotocolPrefix = "wsc.v"
+)
+
+// Capabilities are optional features negotiated on the handshake.
+type Capabilities uint32
+
+const (
+	// CapMux means net=mux tunnels are available.
+	CapMux Capabilities = 1 << iota
+	// CapUDPDomain means UDP frames may name destinations by domain.
+	CapUDPDomain
+	// CapHalfClose means TCP tunnels may carry HalfCloseMessage.
+	CapHalfClose
+)
+
+var capabilityNames = []struct {
+	capability Capabilities
+	name       string
+}{
+	{CapMux, "mux"},
+	{CapUDPDomain, "udp-domain"},
+	{CapHalfClose, "half-close"},
+}
+
+func (caps Capabilities) Has(capability Capabilities) bool {
+	return caps&capability == capability
+}
+
+// String lists the capabilities comma separated, as sent on the handshake.
+func (caps Capabilities) String() string {
+	names := make([]string, 0, len(capabilityNames))
+	for _, c := range capabilityNames {
+		if caps.Has(c.capability) {
+			names = append(names, c.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// ParseCapabilities reads a comma separated capability list, ignoring names it
+// doesn't know so newer peers can offer more.
+func ParseCapabilities(value string) Capabilities {
+	var caps Capabilities
+	for _, name := range strings.Split(value, ",") {
+		name = strings.TrimSpace(name)
+		for _, c := range capabilityNames {
+			if c.name == name {
+				caps |= c.capability
+			}
+		}
+	}
+	return caps
+}
+
+// VersionSubprotocol is the Sec-WebSocket-Protocol value announcing version.
+func VersionSubprotocol(version int) string {
+	return VersionSubprotocolPrefix + strconv.Itoa(version)
+}
+
+// ParseVersionSubprotocol returns the version a subprotocol announces, or
+// false when value isn't a version subprotocol.
+func ParseVersionSubprotocol(value string) (int, bool) {
+	encoded, ok := strings.CutPrefix(value, VersionSubprotocolPrefix)
+	if !ok {
+		return 0, false
+	}
+	version, err := strconv.Atoi(encoded)
+	if err != nil || version < Version1 {
+		return 0, false
+	}
+	return version, true
+}
+
+// NegotiateVersion picks the version both sides speak, given the highest one
+// the client offered; zero means the client didn't say and gets Version1.
+func NegotiateVersion(offered int) int {
+	if offered < Version1 {
+		return Version1
+	}
+	return min(offered, LatestVersion)
+}
@@ -0,0 +1,69 @@
+package protocol
+
+import "testing"
+
+func TestCapabilities(t *testing.T) {
+	tests := []struct {
+		value string
+		caps  Capabilities
+		str   string
+	}{
+		{"", 0, ""},
+		{"mux", CapMux, "mux"},
+		{"half-close,mux", CapMux | CapHalfClose, "mux,half-close"},
+		{" mux , udp-domain ", CapMux | CapUDPDomain, "mux,udp-domain"},
+		{"mux,future-thing,half-close", CapMux | CapHalfClose, "mux,half-close"},
+		{"compression", 0, ""},
+	}
+
+	for _, test := range tests {
+		caps := ParseCapabilities(test.value)
+		if caps != test.caps {
+			t.Errorf("ParseCapabilities(%q) = %b, want %b", test.value, caps, test.caps)
+		}
+		if str := caps.String(); str != test.str {
+			t.Errorf("Capabilities(%b).String() = %q, want %q", caps, str, test.str)
+		}
+		if ParseCapabilities(caps.String()) != caps {
+			t.Errorf("Capabilities(%b) doesn't survive a round trip", caps)
+		}
+	}
+
+	caps := CapMux | CapHalfClose
+	if !caps.Has(CapMux) || caps.Has(CapUDPDomain) || caps.Has(CapMux|CapUDPDomain) {
+		t.Errorf("Has on %b gave wrong answers", caps)
+	}
+}
+
+func TestVersionSubprotocol(t *testing.T) {
+	for _, version := range []int{Version1, Version2, 17} {
+		got, ok := ParseVersionSubprotocol(VersionSubprotocol(version))
+		if !ok || got != version {
+			t.Errorf("ParseVersionSubprotocol(VersionSubprotocol(%d)) = %d, %v", version, got, ok)
+		}
+	}
+	for _, value := range []string{Subprotocol, "wsc.v", "wsc.v0", "wsc.v-1", "wsc.vx", AuthSubprotocol("token")} {
+		if version, ok := ParseVersionSubprotocol(value); ok {
+			t.Errorf("ParseVersionSubprotocol(%q) = %d, want not a version", value, version)
+		}
+	}
+}
+
+func TestNegotiateVersion(t *testing.T) {
+	tests := []struct {
+		offered int
+		want    int
+	}{
+		{0, Version1},
+		{-1, Version1},
+		{Version1, Version1},
+		{Version2, Version2},
+		{LatestVersion + 1, LatestVersion},
+	}
+
+	for _, test := range tests {
+		if got := NegotiateVersion(test.offered); got != test.want {
+			t.Errorf("NegotiateVersion(%d) = %d, want %d", test.offered, got, test.want)
+		}
+	}
+}
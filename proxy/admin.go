@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"cmp"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// UserInfo is what the admin API shows about a user.
+type UserInfo struct {
+	ID                int64             `json:"id"`
+	UploadBytes       int64             `json:"upload_bytes"`
+	DownloadBytes     int64             `json:"download_bytes"`
+	UploadRateLimit   int64             `json:"upload_rate_limit"`
+	DownloadRateLimit int64             `json:"download_rate_limit"`
+	RateBurst         int64             `json:"rate_burst"`
+	RateOverridden    bool              `json:"rate_overridden,omitempty"`
+	ExpiresAt         time.Time         `json:"expires_at,omitzero"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	Conns             []ConnInfo        `json:"conns"`
+}
+
+// RateLimitUpdate is the body of PUT /users/{id}/rate-limit, in bytes per
+// second. A zero rate is unlimited and a zero burst one second worth of
+// traffic.
+type RateLimitUpdate struct {
+	Upload   int64 `json:"upload"`
+	Download int64 `json:"download"`
+	Burst    int64 `json:"burst"`
+}
+
+// Admin serves the operator API of a Proxy. Mount it on a listener clients
+// can't reach; every request must carry Token as a bearer token.
+//
+//	GET    /users                     list users and their connections
+//	GET    /users/{id}                show one user
+//	DELETE /users/{id}                close all connections of a user
+//	DELETE /users/{id}/conns/{conn}   close one connection
+//	PUT    /users/{id}/rate-limit     override the rate limit the authenticator sets
+//	DELETE /users/{id}/rate-limit     go back to the authenticator's rate limit
+//	POST   /users/{id}/report         report the user's usage now
+type Admin struct {
+	Proxy *Proxy
+	Token string
+
+	mux *http.ServeMux
+}
+
+func NewAdmin(pro *Proxy, token string) *Admin {
+	admin := &Admin{Proxy: pro, Token: token, mux: http.NewServeMux()}
+	admin.mux.HandleFunc("GET /users", admin.listUsers)
+	admin.mux.HandleFunc("GET /users/{id}", admin.showUser)
+	admin.mux.HandleFunc("DELETE /users/{id}", admin.killUser)
+	admin.mux.HandleFunc("DELETE /users/{id}/conns/{conn}", admin.killConn)
+	admin.mux.HandleFunc("PUT /users/{id}/rate-limit", admin.setRateLimit)
+	admin.mux.HandleFunc("DELETE /users/{id}/rate-limit", admin.clearRateLimit)
+	admin.mux.HandleFunc("POST /users/{id}/report", admin.report)
+	return admin
+}
+
+func (admin *Admin) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
+	token, found := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer ")
+	if admin.Token == "" || !found || subtle.ConstantTimeCompare([]byte(token), []byte(admin.Token)) != 1 {
+		http.Error(writer, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+	admin.mux.ServeHTTP(writer, request)
+}
+
+func (admin *Admin) listUsers(writer http.ResponseWriter, request *http.Request) {
+	admin.Proxy.userMutex.Lock()
+	users := make([]*User, 0, len(admin.Proxy.Users))
+	for _, user := range admin.Proxy.Users {
+		users = append(users, user)
+	}
+	admin.Proxy.userMutex.Unlock()
+
+	infos := make([]UserInfo, 0, len(users))
+	for _, user := range users {
+		infos = append(infos, userInfo(user))
+	}
+	slices.SortFunc(infos, func(a, b UserInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	writeJSON(writer, infos)
+}
+
+func (admin *Admin) showUser(writer http.ResponseWriter, request *http.Request) {
+	user, err := admin.requestUser(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	writeJSON(writer, userInfo(user))
+}
+
+func (admin *Admin) killUser(writer http.ResponseWriter, request *http.Request) {
+	user, err := admin.requestUser(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	user.Terminate(ws.StatusPolicyViolation, "disconnected by administrator")
+	slog.Info("Administrator disconnected user", slog.Int64("user-id", user.ID))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *Admin) killConn(writer http.ResponseWriter, request *http.Request) {
+	user, err := admin.requestUser(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	id, err := strconv.ParseUint(request.PathValue("conn"), 10, 64)
+	if err != nil {
+		http.Error(writer, "Invalid connection id", http.StatusBadRequest)
+		return
+	}
+	if err := user.CloseConn(id, ws.StatusPolicyViolation, "disconnected by administrator"); err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	slog.Info("Administrator disconnected connection", slog.Int64("user-id", user.ID), slog.Uint64("conn-id", id))
+	writer.WriteHeader(http.StatusNoContent)
+}
+
+func (admin *Admin) setRateLimit(writer http.ResponseWriter, request *http.Request) {
+	user, err := admin.requestUser(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	update := RateLimitUpdate{}
+	if err := json.NewDecoder(request.Body).Decode(&update); err != nil {
+		http.Error(writer, "Invalid rate limit: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if update.Upload < 0 || update.Download < 0 || update.Burst < 0 {
+		http.Error(writer, "Rate limits can't be negative", http.StatusBadRequest)
+		return
+	}
+	user.OverrideRateLimit(update.Upload, update.Download, update.Burst)
+	writeJSON(writer, userInfo(user))
+}
+
+func (admin *Admin) clearRateLimit(writer http.ResponseWriter, request *http.Request) {
+	user, err := admin.requestUser(request)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	user.ClearRateLimitOverride()
+	writeJSON(writer, userInfo(user))
+}
+
+func (admin *Admin) report(writer http.ResponseWriter, request *http.Request) {
+	admin.Proxy.userMutex.Lock()
+	user, err := admin.lookupUser(request)
+	if err == nil {
+		admin.Proxy.reportUser(request.Context(), user, true)
+	}
+	admin.Proxy.userMutex.Unlock()
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusNotFound)
+		return
+	}
+	writer.WriteHeader(http.StatusAccepted)
+}
+
+func (admin *Admin) requestUser(request *http.Request) (*User, error) {
+	admin.Proxy.userMutex.Lock()
+	defer admin.Proxy.userMutex.Unlock()
+	return admin.lookupUser(request)
+}
+
+// lookupUser must be called with userMutex held.
+func (admin *Admin) lookupUser(request *http.Request) (*User, error) {
+	id, err := strconv.ParseInt(request.PathValue("id"), 10, 64)
+	if err != nil {
+		return nil, errors.New("invalid user id")
+	}
+	user, exists := admin.Proxy.Users[id]
+	if !exists {
+		return nil, errors.New("user doesn't exist")
+	}
+	return user, nil
+}
+
+func userInfo(user *User) UserInfo {
+	upload, download, burst := user.RateLimits()
+	user.connMutex.Lock()
+	expiresAt, metadata, overridden := user.ExpiresAt, user.Metadata, user.rateOverride != nil
+	user.connMutex.Unlock()
+	return UserInfo{
+		ID:                user.ID,
+		UploadBytes:       user.UploadBytes.Load(),
+		DownloadBytes:     user.DownloadBytes.Load(),
+		UploadRateLimit:   upload,
+		DownloadRateLimit: download,
+		RateBurst:         burst,
+		RateOverridden:    overridden,
+		ExpiresAt:         expiresAt,
+		Metadata:          metadata,
+		Conns:             user.ConnInfos(),
+	}
+}
+
+func writeJSON(writer http.ResponseWriter, value any) {
+	writer.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(writer).Encode(value); err != nil {
+		slog.Debug("Failed to write admin response: " + err.Error())
+	}
+}
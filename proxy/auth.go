@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"slices"
+	"time"
+)
+
+type Authenticator interface {
+	Authenticate(ctx context.Context, auth string) (int64, int64, error)
+	ReportUsage(ctx context.Context, id int64, usedTraffic int64) error
+}
+
+// AuthResult is the per-user policy the proxy enforces. Zero values mean "no
+// restriction", except MaxConns which falls back to the proxy default.
+//
+// When authentication fails but the result still carries a UserID, the proxy
+// drops that user's live connections (e.g. an account that just expired).
+//
+// RateLimit applies to both directions unless UploadRateLimit or
+// DownloadRateLimit override it; all limits are shared by every connection of
+// the user.
+//
+// DestinationRules are checked before the proxy's DestinationPolicy, so they
+// can open up or further restrict what this user may reach.
+//
+// Outbound names an entry of Proxy.Outbounds to carry this user's traffic;
+// empty means Proxy.Outbound.
+//
+// RemainingBytes is the traffic the user may still use and is only enforced
+// when HasQuota is set, so a used-up allowance of zero or less blocks the user
+// instead of lifting the limit.
+//
+// SourceAddrs pins the local addresses the user's traffic leaves from,
+// overriding the outbound's EgressPool for the matching address family.
+// FamilyPreference overrides Proxy.FamilyPreference when set.
+type AuthResult struct {
+	UserID            int64
+	RateLimit         int64
+	UploadRateLimit   int64
+	DownloadRateLimit int64
+	RateBurst         int64
+	MaxConns          int
+	ExpiresAt         time.Time
+	RemainingBytes    int64
+	HasQuota          bool
+	AllowedNetworks   []string
+	DestinationRules  []DestinationRule
+	Outbound          string
+	SourceAddrs       []netip.Addr
+	FamilyPreference  FamilyPreference
+	Metadata          map[string]string
+}
+
+// SessionAuthenticator authenticates tunnels and receives their usage.
+//
+// ReportUsage is at-least-once when the proxy has a UsageJournal: a record
+// whose acknowledgement was lost to a crash is delivered again with the same
+// ID, so implementations must ignore IDs they have already applied or bill it
+// twice.
+type SessionAuthenticator interface {
+	AuthenticateSession(ctx context.Context, auth string) (*AuthResult, error)
+	ReportUsage(ctx context.Context, record UsageRecord) error
+}
+
+// LegacySessionAuthenticator reports a single traffic total per user, like
+// SessionAuthenticator did before usage was split by direction.
+type LegacySessionAuthenticator interface {
+	AuthenticateSession(ctx context.Context, auth string) (*AuthResult, error)
+	ReportUsage(ctx context.Context, id int64, usedTraffic int64) error
+}
+
+func (result *AuthResult) Expired(now time.Time) bool {
+	return !result.ExpiresAt.IsZero() && !now.Before(result.ExpiresAt)
+}
+
+func (result *AuthResult) RateLimits() (upload int64, download int64) {
+	upload, download = result.RateLimit, result.RateLimit
+	if result.UploadRateLimit > 0 {
+		upload = result.UploadRateLimit
+	}
+	if result.DownloadRateLimit > 0 {
+		download = result.DownloadRateLimit
+	}
+	return upload, download
+}
+
+func (result *AuthResult) AllowsNetwork(network string) bool {
+	return len(result.AllowedNetworks) == 0 || slices.Contains(result.AllowedNetworks, network)
+}
+
+var _ SessionAuthenticator = legacyAuthenticator{}
+
+type legacyAuthenticator struct {
+	authenticator Authenticator
+}
+
+// AdaptAuthenticator wraps an Authenticator that only knows about user IDs and
+// rates so it can be used where a SessionAuthenticator is expected.
+func AdaptAuthenticator(authenticator Authenticator) SessionAuthenticator {
+	return legacyAuthenticator{authenticator: authenticator}
+}
+
+func (auth legacyAuthenticator) AuthenticateSession(ctx context.Context, token string) (*AuthResult, error) {
+	uid, rate, err := auth.authenticator.Authenticate(ctx, token)
+	if err != nil {
+		if uid != 0 {
+			return &AuthResult{UserID: uid}, err
+		}
+		return nil, err
+	}
+	return &AuthResult{UserID: uid, RateLimit: rate}, nil
+}
+
+func (auth legacyAuthenticator) ReportUsage(ctx context.Context, record UsageRecord) error {
+	return auth.authenticator.ReportUsage(ctx, record.UserID, record.TotalBytes())
+}
+
+var _ SessionAuthenticator = legacySessionAuthenticator{}
+
+type legacySessionAuthenticator struct {
+	authenticator LegacySessionAuthenticator
+}
+
+// AdaptSessionAuthenticator lets an authenticator that reports usage as one
+// total keep working; it receives upload plus download of each record.
+func AdaptSessionAuthenticator(authenticator LegacySessionAuthenticator) SessionAuthenticator {
+	return legacySessionAuthenticator{authenticator: authenticator}
+}
+
+func (auth legacySessionAuthenticator) AuthenticateSession(ctx context.Context, token string) (*AuthResult, error) {
+	return auth.authenticator.AuthenticateSession(ctx, token)
+}
+
+func (auth legacySessionAuthenticator) ReportUsage(ctx context.Context, record UsageRecord) error {
+	return auth.authenticator.ReportUsage(ctx, record.UserID, record.TotalBytes())
+}
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/itsabgr/ge"
+)
+
+// maxCloseReason is what fits in a close frame next to the status code.
+const maxCloseReason = 123
+
+func closeFrameBody(code protocol.CloseCode, reason string) []byte {
+	if len(reason) > maxCloseReason {
+		reason = strings.ToValidUTF8(reason[:maxCloseReason], "")
+	}
+	return ws.NewCloseFrameBody(ws.StatusCode(code), reason)
+}
+
+// reject refuses a tunnel. Version2 clients get an upgrade carrying
+// protocol.CloseCodeHeader followed by a close frame, older ones the HTTP
+// error they always got.
+func (pro *Proxy) reject(writer http.ResponseWriter, request *http.Request, hs handshake, code protocol.CloseCode, status int, reason string) {
+	if hs.version < protocol.Version2 {
+		http.Error(writer, reason, status)
+		return
+	}
+
+	upgrader := hs.upgrader()
+	upgrader.Header.Set(protocol.CloseCodeHeader, strconv.Itoa(int(code)))
+	conn, _, _, err := upgrader.Upgrade(request, writer)
+	if err != nil {
+		// The upgrader has already answered with an HTTP error.
+		if conn != nil {
+			conn.Close()
+		}
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+	wsutil.WriteServerMessage(conn, ws.OpClose, closeFrameBody(code, reason))
+	conn.Close()
+}
+
+// dialCloseCode tells apart why connecting to a target failed.
+func dialCloseCode(err error) protocol.CloseCode {
+	if _, ok := ge.As[*DeniedError](err); ok {
+		return protocol.ClosePolicyDenied
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return protocol.CloseDialRefused
+	}
+	if replyErr, ok := ge.As[*socksReplyError](err); ok {
+		switch replyErr.reply {
+		case socksReplyConnectionRefused:
+			return protocol.CloseDialRefused
+		case socksReplyNotAllowed:
+			return protocol.ClosePolicyDenied
+		}
+	}
+	return protocol.CloseHostUnreachable
+}
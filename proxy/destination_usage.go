@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"cmp"
+	"context"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+)
+
+// DestinationUsage is the traffic of one user to one destination within a
+// reporting window. Destination is host:port as the client asked for it, so
+// it holds the domain when the client gave one. Duration sums the lifetime of
+// connections that closed in the window.
+type DestinationUsage struct {
+	Destination   string
+	UploadBytes   int64
+	DownloadBytes int64
+	Connections   int64
+	Duration      time.Duration
+}
+
+func (usage *DestinationUsage) TotalBytes() int64 {
+	return usage.UploadBytes + usage.DownloadBytes
+}
+
+func (usage *DestinationUsage) merge(other *DestinationUsage) {
+	usage.UploadBytes += other.UploadBytes
+	usage.DownloadBytes += other.DownloadBytes
+	usage.Connections += other.Connections
+	usage.Duration += other.Duration
+}
+
+// DestinationUsageRecord carries the busiest destinations of a user for the
+// same window as the matching UsageRecord. Everything else is folded into
+// Other.
+type DestinationUsageRecord struct {
+	UserID       int64
+	Start        time.Time
+	End          time.Time
+	Destinations []DestinationUsage
+	Other        DestinationUsage
+}
+
+type DestinationUsageSink interface {
+	ReportDestinationUsage(ctx context.Context, record DestinationUsageRecord) error
+}
+
+// destinationStatsSlack is how many more destinations than the reported top
+// N are tracked, so a destination that gets busy late in the window still
+// has a chance to make the cut.
+const destinationStatsSlack = 4
+
+// destinationStats keeps a bounded per-destination breakdown. When full, the
+// smallest destination is folded into other to make room for a new one.
+type destinationStats struct {
+	mutex   sync.Mutex
+	topN    int
+	entries map[string]*DestinationUsage
+	other   DestinationUsage
+}
+
+func newDestinationStats(topN int) *destinationStats {
+	return &destinationStats{
+		topN:    topN,
+		entries: map[string]*DestinationUsage{},
+	}
+}
+
+func (stats *destinationStats) entry(destination string) *DestinationUsage {
+	if usage, found := stats.entries[destination]; found {
+		return usage
+	}
+	if len(stats.entries) >= stats.topN*destinationStatsSlack {
+		var smallest *DestinationUsage
+		for _, usage := range stats.entries {
+			if smallest == nil || usage.TotalBytes() < smallest.TotalBytes() {
+				smallest = usage
+			}
+		}
+		stats.other.merge(smallest)
+		delete(stats.entries, smallest.Destination)
+	}
+	usage := &DestinationUsage{Destination: destination}
+	stats.entries[destination] = usage
+	return usage
+}
+
+func (stats *destinationStats) add(destination string, upload int64, download int64) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	usage := stats.entry(destination)
+	usage.UploadBytes += upload
+	usage.DownloadBytes += download
+}
+
+func (stats *destinationStats) open(destination string) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.entry(destination).Connections++
+}
+
+func (stats *destinationStats) close(destination string, duration time.Duration) {
+	if stats == nil {
+		return
+	}
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.entry(destination).Duration += duration
+}
+
+// take resets the window and returns its top N destinations by traffic.
+func (stats *destinationStats) take() ([]DestinationUsage, DestinationUsage) {
+	stats.mutex.Lock()
+	entries, other := stats.entries, stats.other
+	stats.entries = map[string]*DestinationUsage{}
+	stats.other = DestinationUsage{}
+	stats.mutex.Unlock()
+
+	top := make([]DestinationUsage, 0, len(entries))
+	for _, usage := range entries {
+		top = append(top, *usage)
+	}
+	slices.SortFunc(top, func(a, b DestinationUsage) int {
+		return cmp.Compare(b.TotalBytes(), a.TotalBytes())
+	})
+	if len(top) > stats.topN {
+		for i := stats.topN; i < len(top); i++ {
+			other.merge(&top[i])
+		}
+		top = top[:stats.topN]
+	}
+	other.Destination = ""
+	return top, other
+}
+
+func (pro *Proxy) reportDestinationUsage(ctx context.Context, user *User, record UsageRecord) {
+	stats := user.destinationStats()
+	if stats == nil || pro.DestinationUsageSink == nil {
+		return
+	}
+	top, other := stats.take()
+	if len(top) == 0 && other.Connections == 0 && other.TotalBytes() == 0 {
+		return
+	}
+	err := pro.DestinationUsageSink.ReportDestinationUsage(ctx, DestinationUsageRecord{
+		UserID:       user.ID,
+		Start:        record.Start,
+		End:          record.End,
+		Destinations: top,
+		Other:        other,
+	})
+	if err != nil {
+		slog.Debug("Failed to report destination usage: "+err.Error(), slog.Int64("user-id", user.ID))
+	}
+}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/fnv"
+	"net/netip"
+	"sync/atomic"
+)
+
+type egressContextKey struct{}
+
+// EgressInfo tells an Outbound whom a dial is made for.
+type EgressInfo struct {
+	UserID      int64
+	SourceAddrs []netip.Addr
+}
+
+func ContextWithEgress(ctx context.Context, info EgressInfo) context.Context {
+	return context.WithValue(ctx, egressContextKey{}, info)
+}
+
+func EgressFromContext(ctx context.Context) (EgressInfo, bool) {
+	info, ok := ctx.Value(egressContextKey{}).(EgressInfo)
+	return info, ok
+}
+
+type EgressMode int
+
+const (
+	// EgressRoundRobin rotates through the pool on every dial.
+	EgressRoundRobin EgressMode = iota
+	// EgressSticky always gives a user the same address by hashing its ID.
+	EgressSticky
+)
+
+// EgressPool holds the local addresses outgoing connections may use. The
+// family of the destination decides which list is used; an empty list leaves
+// the choice to the kernel. Addresses pinned by the authenticator win over the
+// pool.
+type EgressPool struct {
+	IPv4 []netip.Addr
+	IPv6 []netip.Addr
+	Mode EgressMode
+
+	next atomic.Uint64
+}
+
+// Select returns the source address for a dial to dst, or an invalid Addr if
+// no address of the right family is configured.
+func (pool *EgressPool) Select(ctx context.Context, dst netip.Addr) netip.Addr {
+	dst = dst.Unmap()
+	info, _ := EgressFromContext(ctx)
+
+	var pinned []netip.Addr
+	for _, addr := range info.SourceAddrs {
+		if addr.Unmap().Is4() == dst.Is4() {
+			pinned = append(pinned, addr.Unmap())
+		}
+	}
+	if len(pinned) > 0 {
+		return pool.pick(pinned, info.UserID)
+	}
+
+	if pool == nil {
+		return netip.Addr{}
+	}
+	if dst.Is4() {
+		return pool.pick(pool.IPv4, info.UserID)
+	}
+	return pool.pick(pool.IPv6, info.UserID)
+}
+
+func (pool *EgressPool) pick(addrs []netip.Addr, userID int64) netip.Addr {
+	switch len(addrs) {
+	case 0:
+		return netip.Addr{}
+	case 1:
+		return addrs[0]
+	}
+
+	if pool != nil && pool.Mode == EgressSticky {
+		hash := fnv.New64a()
+		hash.Write(binary.BigEndian.AppendUint64(nil, uint64(userID)))
+		return addrs[hash.Sum64()%uint64(len(addrs))]
+	}
+	var n uint64
+	if pool != nil {
+		n = pool.next.Add(1) - 1
+	}
+	return addrs[n%uint64(len(addrs))]
+}
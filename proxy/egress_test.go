@@ -0,0 +1,85 @@
+package proxy
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func mustAddrs(values ...string) []netip.Addr {
+	list := make([]netip.Addr, 0, len(values))
+	for _, value := range values {
+		list = append(list, netip.MustParseAddr(value))
+	}
+	return list
+}
+
+func TestEgressPoolFamily(t *testing.T) {
+	pool := &EgressPool{IPv4: mustAddrs("192.0.2.1"), IPv6: mustAddrs("2001:db8::1")}
+	tests := []struct {
+		pool *EgressPool
+		dst  string
+		want string
+	}{
+		{pool, "198.51.100.1", "192.0.2.1"},
+		{pool, "::ffff:198.51.100.1", "192.0.2.1"},
+		{pool, "2001:db8:1::1", "2001:db8::1"},
+		{&EgressPool{IPv4: mustAddrs("192.0.2.1")}, "2001:db8:1::1", "invalid IP"},
+		{nil, "198.51.100.1", "invalid IP"},
+	}
+
+	for _, test := range tests {
+		if got := test.pool.Select(context.Background(), netip.MustParseAddr(test.dst)); got.String() != test.want {
+			t.Errorf("Select(%s) = %s, want %s", test.dst, got, test.want)
+		}
+	}
+}
+
+func TestEgressPoolRoundRobin(t *testing.T) {
+	pool := &EgressPool{IPv4: mustAddrs("192.0.2.1", "192.0.2.2", "192.0.2.3")}
+	ctx := ContextWithEgress(context.Background(), EgressInfo{UserID: 7})
+	dst := netip.MustParseAddr("198.51.100.1")
+
+	for i, want := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.1"} {
+		if got := pool.Select(ctx, dst); got.String() != want {
+			t.Errorf("dial %d got %s, want %s", i, got, want)
+		}
+	}
+}
+
+func TestEgressPoolSticky(t *testing.T) {
+	pool := &EgressPool{IPv4: mustAddrs("192.0.2.1", "192.0.2.2", "192.0.2.3", "192.0.2.4"), Mode: EgressSticky}
+	dst := netip.MustParseAddr("198.51.100.1")
+
+	seen := map[netip.Addr]bool{}
+	for uid := int64(1); uid <= 32; uid++ {
+		ctx := ContextWithEgress(context.Background(), EgressInfo{UserID: uid})
+		first := pool.Select(ctx, dst)
+		for range 3 {
+			if got := pool.Select(ctx, dst); got != first {
+				t.Fatalf("user %d moved from %s to %s", uid, first, got)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) < 2 {
+		t.Errorf("32 users all hashed onto %v", seen)
+	}
+}
+
+func TestEgressPoolPinned(t *testing.T) {
+	pool := &EgressPool{IPv4: mustAddrs("192.0.2.1"), IPv6: mustAddrs("2001:db8::1")}
+	ctx := ContextWithEgress(context.Background(), EgressInfo{UserID: 1, SourceAddrs: mustAddrs("::ffff:203.0.113.9")})
+
+	if got := pool.Select(ctx, netip.MustParseAddr("198.51.100.1")); got.String() != "203.0.113.9" {
+		t.Errorf("pinned IPv4 Select = %s, want 203.0.113.9", got)
+	}
+	// Pins of the other family leave the pool in charge.
+	if got := pool.Select(ctx, netip.MustParseAddr("2001:db8:1::1")); got.String() != "2001:db8::1" {
+		t.Errorf("IPv6 Select with an IPv4 pin = %s, want 2001:db8::1", got)
+	}
+	var none *EgressPool
+	if got := none.Select(ctx, netip.MustParseAddr("198.51.100.1")); got.String() != "203.0.113.9" {
+		t.Errorf("pinned Select without a pool = %s, want 203.0.113.9", got)
+	}
+}
@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+)
+
+// halfCloser ends a TCP tunnel once both directions finished. Without
+// protocol.CapHalfClose the first direction to finish ends it, as before.
+type halfCloser struct {
+	enabled  bool
+	finished atomic.Int32
+	cancel   context.CancelFunc
+}
+
+func (hc *halfCloser) finish() {
+	if !hc.enabled || hc.finished.Add(1) == 2 {
+		hc.cancel()
+	}
+}
+
+// closeWrite shuts down the writing side of conn when it supports that, like
+// *net.TCPConn does, and closes conn otherwise so the target still sees the
+// end of the stream.
+func closeWrite(conn net.Conn) error {
+	if cw, ok := conn.(interface{ CloseWrite() error }); ok {
+		if err := cw.CloseWrite(); !errors.Is(err, errors.ErrUnsupported) {
+			return err
+		}
+	}
+	return conn.Close()
+}
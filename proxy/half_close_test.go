@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/b00tkitism/wsc/client"
+)
+
+type closeWriteConn struct {
+	net.Conn
+	closeWriteErr error
+	closed        bool
+}
+
+func (conn *closeWriteConn) CloseWrite() error {
+	return conn.closeWriteErr
+}
+
+func (conn *closeWriteConn) Close() error {
+	conn.closed = true
+	return conn.Conn.Close()
+}
+
+type plainConn struct {
+	net.Conn
+	closed bool
+}
+
+func (conn *plainConn) Close() error {
+	conn.closed = true
+	return conn.Conn.Close()
+}
+
+func TestCloseWriteFallsBackToClose(t *testing.T) {
+	failure := errors.New("broken")
+	tests := []struct {
+		name       string
+		err        error
+		wantErr    error
+		wantClosed bool
+	}{
+		{"half-closed", nil, nil, false},
+		{"wsc without half-close", client.ErrHalfCloseUnsupported, nil, true},
+		{"unsupported", errors.ErrUnsupported, nil, true},
+		{"failure", failure, failure, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			conn := &closeWriteConn{Conn: a, closeWriteErr: test.err}
+			if err := closeWrite(conn); !errors.Is(err, test.wantErr) {
+				t.Errorf("closeWrite = %v, want %v", err, test.wantErr)
+			}
+			if conn.closed != test.wantClosed {
+				t.Errorf("closed = %v, want %v", conn.closed, test.wantClosed)
+			}
+		})
+	}
+
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := &plainConn{Conn: a}
+	if err := closeWrite(conn); err != nil || !conn.closed {
+		t.Errorf("closeWrite of a conn without CloseWrite = %v, closed %v", err, conn.closed)
+	}
+}
+
+func TestCloseWriteTCP(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		data, _ := io.ReadAll(conn)
+		conn.Write(data)
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("request"))
+	if err := closeWrite(conn); err != nil {
+		t.Fatalf("closeWrite: %v", err)
+	}
+	// The peer saw EOF and can still answer.
+	if reply, err := io.ReadAll(conn); err != nil || string(reply) != "request" {
+		t.Errorf("reply after half-close = %q, %v", reply, err)
+	}
+}
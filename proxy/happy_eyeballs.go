@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// FamilyPreference controls which address families are dialed and in which
+// order. The zero value prefers IPv6 as RFC 8305 recommends.
+type FamilyPreference int
+
+const (
+	FamilyDefault FamilyPreference = iota
+	FamilyPreferIPv6
+	FamilyPreferIPv4
+	FamilyIPv6Only
+	FamilyIPv4Only
+)
+
+// connectionAttemptDelay is the RFC 8305 delay before starting the next
+// connection attempt while the previous one is still pending.
+const connectionAttemptDelay = 250 * time.Millisecond
+
+// sortAddrs drops addresses the preference excludes and interleaves the two
+// families starting with the preferred one, keeping resolver order within
+// each family. The result is a new slice of unmapped addresses.
+func sortAddrs(addrs []netip.Addr, preference FamilyPreference) []netip.Addr {
+	var v4, v6 []netip.Addr
+	for _, addr := range addrs {
+		addr = addr.Unmap()
+		if addr.Is4() {
+			v4 = append(v4, addr)
+		} else {
+			v6 = append(v6, addr)
+		}
+	}
+
+	first, second := v6, v4
+	switch preference {
+	case FamilyPreferIPv4:
+		first, second = v4, v6
+	case FamilyIPv6Only:
+		second = nil
+	case FamilyIPv4Only:
+		first, second = v4, nil
+	}
+
+	sorted := make([]netip.Addr, 0, len(first)+len(second))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+type dialResult struct {
+	conn net.Conn
+	err  error
+}
+
+// dialHappyEyeballs starts a connection attempt to each address in order,
+// starting the next one after connectionAttemptDelay or as soon as the
+// previous attempt fails. The first established connection wins and the
+// others are canceled.
+func dialHappyEyeballs(ctx context.Context, outbound Outbound, addrs []netip.AddrPort) (net.Conn, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("no address to dial")
+	}
+	if len(addrs) == 1 {
+		return outbound.DialTCP(ctx, addrs[0])
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan dialResult)
+	timer := time.NewTimer(connectionAttemptDelay)
+	defer timer.Stop()
+
+	next, pending := 0, 0
+	startNext := true
+	var firstErr error
+	for {
+		if startNext && next < len(addrs) {
+			addr := addrs[next]
+			next++
+			pending++
+			go func() {
+				conn, err := outbound.DialTCP(ctx, addr)
+				select {
+				case results <- dialResult{conn: conn, err: err}:
+				case <-ctx.Done():
+					if conn != nil {
+						conn.Close()
+					}
+				}
+			}()
+			timer.Reset(connectionAttemptDelay)
+		}
+		startNext = false
+		if pending == 0 {
+			return nil, firstErr
+		}
+
+		select {
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				return result.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			startNext = true
+		case <-timer.C:
+			startNext = true
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (pro *Proxy) familyPreference(user *User) FamilyPreference {
+	if preference := user.FamilyPreference(); preference != FamilyDefault {
+		return preference
+	}
+	return pro.FamilyPreference
+}
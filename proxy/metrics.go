@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Handshake failure reasons reported by wsc_handshake_failures_total.
+const (
+	failureAuth     = "auth"
+	failureEndpoint = "endpoint"
+	failurePolicy   = "policy"
+	failureQuota    = "quota"
+	failureDial     = "dial"
+	failureUpgrade  = "upgrade"
+)
+
+var dialDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type proxyMetrics struct {
+	uploadBytes       atomic.Int64
+	downloadBytes     atomic.Int64
+	evictions         atomic.Int64
+	reportsInFlight   atomic.Int64
+	reports           atomic.Int64
+	reportErrors      atomic.Int64
+	connections       counterVec
+	handshakeFailures counterVec
+	dialDuration      histogramVec
+}
+
+type counterVec struct {
+	mutex  sync.Mutex
+	values map[string]*atomic.Int64
+}
+
+func (vec *counterVec) with(label string) *atomic.Int64 {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	if vec.values == nil {
+		vec.values = map[string]*atomic.Int64{}
+	}
+	value, found := vec.values[label]
+	if !found {
+		value = &atomic.Int64{}
+		vec.values[label] = value
+	}
+	return value
+}
+
+func (vec *counterVec) snapshot() ([]string, []int64) {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	labels := make([]string, 0, len(vec.values))
+	for label := range vec.values {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	values := make([]int64, len(labels))
+	for i, label := range labels {
+		values[i] = vec.values[label].Load()
+	}
+	return labels, values
+}
+
+type histogram struct {
+	counts []atomic.Int64
+	count  atomic.Int64
+	sumNs  atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	for i, bound := range dialDurationBuckets {
+		if seconds <= bound {
+			h.counts[i].Add(1)
+			break
+		}
+	}
+	h.count.Add(1)
+	h.sumNs.Add(int64(d))
+}
+
+type histogramVec struct {
+	mutex  sync.Mutex
+	values map[string]*histogram
+}
+
+func (vec *histogramVec) with(label string) *histogram {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	if vec.values == nil {
+		vec.values = map[string]*histogram{}
+	}
+	value, found := vec.values[label]
+	if !found {
+		value = &histogram{counts: make([]atomic.Int64, len(dialDurationBuckets))}
+		vec.values[label] = value
+	}
+	return value
+}
+
+func (vec *histogramVec) labels() []string {
+	vec.mutex.Lock()
+	defer vec.mutex.Unlock()
+	labels := make([]string, 0, len(vec.values))
+	for label := range vec.values {
+		labels = append(labels, label)
+	}
+	slices.Sort(labels)
+	return labels
+}
+
+// MetricsHandler serves the proxy's counters in the Prometheus text exposition
+// format. Mount it on its own path or listener next to the proxy itself.
+func (pro *Proxy) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, request *http.Request) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		buffered := bufio.NewWriter(writer)
+		pro.writeMetrics(buffered)
+		buffered.Flush()
+	})
+}
+
+func (pro *Proxy) writeMetrics(w *bufio.Writer) {
+	metrics := &pro.metrics
+
+	pro.userMutex.Lock()
+	users := len(pro.Users)
+	pro.userMutex.Unlock()
+
+	writeMetricHeader(w, "wsc_active_users", "gauge", "Users with state on the proxy.")
+	writeMetric(w, "wsc_active_users", "", strconv.Itoa(users))
+
+	writeMetricHeader(w, "wsc_active_connections", "gauge", "Open WebSocket connections by network, mux streams as mux-stream.")
+	labels, values := metrics.connections.snapshot()
+	for i, label := range labels {
+		writeMetric(w, "wsc_active_connections", labelPair("network", label), strconv.FormatInt(values[i], 10))
+	}
+
+	writeMetricHeader(w, "wsc_upload_bytes_total", "counter", "Bytes billed from clients towards destinations.")
+	writeMetric(w, "wsc_upload_bytes_total", "", strconv.FormatInt(metrics.uploadBytes.Load(), 10))
+	writeMetricHeader(w, "wsc_download_bytes_total", "counter", "Bytes billed from destinations towards clients.")
+	writeMetric(w, "wsc_download_bytes_total", "", strconv.FormatInt(metrics.downloadBytes.Load(), 10))
+
+	writeMetricHeader(w, "wsc_handshake_failures_total", "counter", "Tunnel requests that failed before relaying, by reason.")
+	labels, values = metrics.handshakeFailures.snapshot()
+	for i, label := range labels {
+		writeMetric(w, "wsc_handshake_failures_total", labelPair("reason", label), strconv.FormatInt(values[i], 10))
+	}
+
+	writeMetricHeader(w, "wsc_dial_duration_seconds", "histogram", "Time taken to connect to destinations, by network.")
+	for _, label := range metrics.dialDuration.labels() {
+		h := metrics.dialDuration.with(label)
+		var cumulative int64
+		for i, bound := range dialDurationBuckets {
+			cumulative += h.counts[i].Load()
+			writeMetric(w, "wsc_dial_duration_seconds_bucket", labelPair("network", label)+","+labelPair("le", strconv.FormatFloat(bound, 'g', -1, 64)), strconv.FormatInt(cumulative, 10))
+		}
+		count := h.count.Load()
+		writeMetric(w, "wsc_dial_duration_seconds_bucket", labelPair("network", label)+","+labelPair("le", "+Inf"), strconv.FormatInt(count, 10))
+		writeMetric(w, "wsc_dial_duration_seconds_sum", labelPair("network", label), strconv.FormatFloat(time.Duration(h.sumNs.Load()).Seconds(), 'g', -1, 64))
+		writeMetric(w, "wsc_dial_duration_seconds_count", labelPair("network", label), strconv.FormatInt(count, 10))
+	}
+
+	writeMetricHeader(w, "wsc_connection_evictions_total", "counter", "Connections closed because their user opened one beyond its limit.")
+	writeMetric(w, "wsc_connection_evictions_total", "", strconv.FormatInt(metrics.evictions.Load(), 10))
+
+	writeMetricHeader(w, "wsc_usage_reports_in_flight", "gauge", "ReportUsage calls waiting for the authenticator.")
+	writeMetric(w, "wsc_usage_reports_in_flight", "", strconv.FormatInt(metrics.reportsInFlight.Load(), 10))
+	writeMetricHeader(w, "wsc_usage_reports_total", "counter", "ReportUsage calls made.")
+	writeMetric(w, "wsc_usage_reports_total", "", strconv.FormatInt(metrics.reports.Load(), 10))
+	writeMetricHeader(w, "wsc_usage_report_errors_total", "counter", "ReportUsage calls that failed.")
+	writeMetric(w, "wsc_usage_report_errors_total", "", strconv.FormatInt(metrics.reportErrors.Load(), 10))
+
+	if pro.journal != nil {
+		writeMetricHeader(w, "wsc_usage_journal_pending", "gauge", "Usage records in the journal waiting for delivery.")
+		writeMetric(w, "wsc_usage_journal_pending", "", strconv.Itoa(pro.journal.Pending()))
+	}
+}
+
+func writeMetricHeader(w *bufio.Writer, name string, kind string, help string) {
+	w.WriteString("# HELP " + name + " " + help + "\n")
+	w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func writeMetric(w *bufio.Writer, name string, labels string, value string) {
+	w.WriteString(name)
+	if labels != "" {
+		w.WriteString("{" + labels + "}")
+	}
+	w.WriteString(" " + value + "\n")
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func labelPair(name string, value string) string {
+	return name + `="` + labelEscaper.Replace(value) + `"`
+}
+
+func (pro *Proxy) handshakeFailed(reason string) {
+	pro.metrics.handshakeFailures.with(reason).Add(1)
+}
+
+// reportUsage calls the authenticator's ReportUsage, keeping count of the
+// calls in flight and the failed ones.
+func (pro *Proxy) reportUsage(ctx context.Context, record UsageRecord) error {
+	pro.metrics.reportsInFlight.Add(1)
+	defer pro.metrics.reportsInFlight.Add(-1)
+	pro.metrics.reports.Add(1)
+	err := pro.Auth.ReportUsage(ctx, record)
+	if err != nil {
+		pro.metrics.reportErrors.Add(1)
+	}
+	return err
+}
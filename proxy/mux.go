@@ -0,0 +1,215 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/b00tkitism/wsc/internal/mux"
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/itsabgr/ge"
+	"golang.org/x/sync/errgroup"
+)
+
+var _ mux.FrameConn = &muxFrameConn{}
+
+// muxFrameConn carries mux frames in WebSocket messages. When frame overhead
+// is billed it accounts whole frames, otherwise streams count their payload.
+type muxFrameConn struct {
+	conn   net.Conn
+	reader *wsutil.Reader
+	writer messageWriter
+
+	countUpload   func(int64)
+	countDownload func(int64)
+}
+
+func (fc *muxFrameConn) ReadFrame() ([]byte, error) {
+	for {
+		header, err := fc.reader.NextFrame()
+		if err != nil {
+			return nil, err
+		}
+
+		switch header.OpCode {
+		case ws.OpPing:
+			payload, err := io.ReadAll(fc.reader)
+			if err != nil {
+				return nil, err
+			}
+			if err := fc.writer.WriteMessage(ws.OpPong, payload); err != nil {
+				return nil, err
+			}
+			continue
+		case ws.OpPong:
+			if err := fc.reader.Discard(); err != nil {
+				return nil, err
+			}
+			continue
+		case ws.OpClose:
+			fc.writer.WriteMessage(ws.OpClose, nil)
+			return nil, io.EOF
+		}
+
+		if fc.countUpload != nil {
+			fc.countUpload(int64(ws.HeaderSize(header)) + header.Length)
+		}
+		// MaxFrameSize bounds single frames only; a message continued over
+		// many frames must not grow without limit either.
+		const maxMessage = protocol.MuxFrameHeaderLen + protocol.MuxMaxDataPayload
+		data, err := io.ReadAll(io.LimitReader(fc.reader, maxMessage+1))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxMessage {
+			return nil, errors.New("mux message too large")
+		}
+		return data, nil
+	}
+}
+
+func (fc *muxFrameConn) WriteFrame(data []byte) error {
+	if fc.countDownload != nil {
+		fc.countDownload(int64(ws.HeaderSize(ws.Header{Length: int64(len(data))}) + len(data)))
+	}
+	return fc.writer.WriteMessage(ws.OpBinary, data)
+}
+
+func (fc *muxFrameConn) Close() error {
+	return fc.conn.Close()
+}
+
+func (pro *Proxy) pipeMux(ctx context.Context, user *User, outbound Outbound, wsConn net.Conn, hs handshake) error {
+	wsLReader, err := user.ConnReader(wsConn)
+	if err != nil {
+		return err
+	}
+	wsWriter, err := user.messageWriter(wsConn)
+	if err != nil {
+		return err
+	}
+
+	wsReader := wsutil.NewReader(wsLReader, ws.StateServerSide)
+	wsReader.MaxFrameSize = protocol.MuxFrameHeaderLen + protocol.MuxMaxDataPayload
+	frameConn := &muxFrameConn{
+		conn:   wsConn,
+		reader: wsReader,
+		writer: wsWriter,
+	}
+	if pro.CountFrameOverhead {
+		frameConn.countUpload = user.AddUpload
+		frameConn.countDownload = user.AddDownload
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	session := mux.NewServerSession(frameConn, mux.Config{MaxStreams: pro.MaximumMuxStreams, CloseCodes: hs.version >= protocol.Version2}, func(stream *mux.Stream, endpoint string) {
+		pro.serveMuxStream(ctx, user, outbound, wsConn, stream, endpoint)
+	})
+
+	err = session.Serve()
+	// Streams must be done counting traffic before the handler returns, or
+	// Shutdown could flush usage without their last bytes.
+	cancel()
+	session.Wait()
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	return err
+}
+
+func (pro *Proxy) serveMuxStream(ctx context.Context, user *User, outbound Outbound, wsConn net.Conn, stream *mux.Stream, endpoint string) {
+	defer stream.Close()
+
+	if !user.openStream(wsConn) {
+		stream.Reject(0, "connection limit reached")
+		return
+	}
+	defer user.closeStream(wsConn)
+
+	connections := pro.metrics.connections.with("mux-stream")
+	connections.Add(1)
+	defer connections.Add(-1)
+
+	addr, err := parseEndpointAddr(ctx, pro.resolver(), endpoint, pro.familyPreference(user), pro.destinationChecker(user))
+	if err != nil {
+		if _, ok := ge.As[*DeniedError](err); ok {
+			stream.Reject(protocol.ClosePolicyDenied, err.Error())
+			return
+		}
+		if _, ok := ge.As[*resolveError](err); ok {
+			stream.Reject(protocol.CloseDNSFailure, "Failed to parse endpoint: "+err.Error())
+			return
+		}
+		stream.Reject(0, "Failed to parse endpoint: "+err.Error())
+		return
+	}
+
+	dialStart := time.Now()
+	tcpConn, err := dialHappyEyeballs(ctx, outbound, addr.addrPorts())
+	pro.metrics.dialDuration.with("mux").observe(time.Since(dialStart))
+	if err != nil {
+		stream.Reject(dialCloseCode(err), "Failed to dial endpoint: "+err.Error())
+		return
+	}
+	defer tcpConn.Close()
+
+	if err := stream.Accept(); err != nil {
+		return
+	}
+
+	destination := addr.String()
+	user.destinations.open(destination)
+	defer func(start time.Time) {
+		user.destinations.close(destination, time.Since(start))
+	}(time.Now())
+
+	// With frame overhead billed, the session accounts whole frames already.
+	countUpload := func(n int64) {
+		if !pro.CountFrameOverhead {
+			user.AddUpload(n)
+		}
+		user.destinations.add(destination, n, 0)
+	}
+	countDownload := func(n int64) {
+		if !pro.CountFrameOverhead {
+			user.AddDownload(n)
+		}
+		user.destinations.add(destination, 0, n)
+	}
+
+	eg := errgroup.Group{}
+	eg.Go(func() error {
+		defer tcpConn.Close()
+		return copyCounted(countUpload, tcpConn, stream)
+	})
+	eg.Go(func() error {
+		defer stream.Close()
+		return copyCounted(countDownload, stream, tcpConn)
+	})
+	eg.Wait()
+}
+
+func copyCounted(count func(int64), dst io.Writer, src io.Reader) error {
+	pack := make([]byte, connReadSize)
+	for {
+		n, err := src.Read(pack)
+		if n > 0 {
+			if _, wErr := dst.Write(pack[:n]); wErr != nil {
+				return wErr
+			}
+			count(int64(n))
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+	}
+}
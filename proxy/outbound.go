@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// defaultHandshakeTimeout bounds talking to an upstream proxy when the
+// outbound doesn't set its own timeout.
+const defaultHandshakeTimeout = 10 * time.Second
+
+// handshakeDeadline is the earlier of ctx's deadline and timeout from now, so
+// a stalled upstream can't hold a dial forever.
+func handshakeDeadline(ctx context.Context, timeout time.Duration) time.Time {
+	if timeout <= 0 {
+		timeout = defaultHandshakeTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	if ctxDeadline, ok := ctx.Deadline(); ok && ctxDeadline.Before(deadline) {
+		return ctxDeadline
+	}
+	return deadline
+}
+
+// Outbound opens the proxy's side of a tunnel. Destinations are already
+// resolved and checked against the destination policy.
+//
+// ListenUDP receives the primary destination of the tunnel; the returned
+// PacketConn may still be used to reach any other address.
+type Outbound interface {
+	DialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error)
+	ListenUDP(ctx context.Context, target netip.AddrPort) (net.PacketConn, error)
+}
+
+var _ Outbound = &DirectOutbound{}
+
+// DirectOutbound connects from the proxy host itself, optionally binding to
+// an address from Pool.
+type DirectOutbound struct {
+	Dialer *net.Dialer
+	Pool   *EgressPool
+}
+
+func (outbound *DirectOutbound) DialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	dialer := net.Dialer{}
+	if outbound.Dialer != nil {
+		dialer = *outbound.Dialer
+	}
+	if source := outbound.Pool.Select(ctx, addr.Addr()); source.IsValid() {
+		dialer.LocalAddr = &net.TCPAddr{IP: source.AsSlice()}
+	}
+	return dialer.DialContext(ctx, "tcp", addr.String())
+}
+
+// ListenUDP binds a dual-stack socket unless a source address is selected,
+// in which case the socket is limited to that address family.
+func (outbound *DirectOutbound) ListenUDP(ctx context.Context, target netip.AddrPort) (net.PacketConn, error) {
+	lc := net.ListenConfig{}
+	source := outbound.Pool.Select(ctx, target.Addr())
+	if !source.IsValid() {
+		return lc.ListenPacket(ctx, "udp", ":0")
+	}
+	network := "udp6"
+	if source.Is4() {
+		network = "udp4"
+	}
+	return lc.ListenPacket(ctx, network, netip.AddrPortFrom(source, 0).String())
+}
+
+// userOutbound picks the user's outbound by the name the authenticator gave it,
+// falling back to Proxy.Outbound.
+func (pro *Proxy) userOutbound(user *User) (Outbound, error) {
+	name := user.OutboundName()
+	if name == "" {
+		if pro.Outbound == nil {
+			return defaultOutbound, nil
+		}
+		return pro.Outbound, nil
+	}
+	outbound, found := pro.Outbounds[name]
+	if !found {
+		return nil, errors.New("unknown outbound: " + name)
+	}
+	return outbound, nil
+}
+
+var defaultOutbound = &DirectOutbound{}
@@ -0,0 +1,92 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"time"
+)
+
+var _ Outbound = &HTTPConnectOutbound{}
+
+// HTTPConnectOutbound tunnels TCP through an upstream HTTP proxy using
+// CONNECT. It can't carry UDP. HandshakeTimeout bounds the CONNECT exchange,
+// defaultHandshakeTimeout when zero.
+type HTTPConnectOutbound struct {
+	Address          string
+	Username         string
+	Password         string
+	Dialer           *net.Dialer
+	HandshakeTimeout time.Duration
+}
+
+func (outbound *HTTPConnectOutbound) DialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	dialer := outbound.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", outbound.Address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetDeadline(handshakeDeadline(ctx, outbound.HandshakeTimeout))
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		Host:   addr.String(),
+		Header: http.Header{},
+	}
+	request.URL = &url.URL{Host: addr.String()}
+	if outbound.Username != "" || outbound.Password != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(outbound.Username + ":" + outbound.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+	if err := request.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.New("upstream proxy refused connect: " + response.Status)
+	}
+
+	conn.SetDeadline(time.Time{})
+	if reader.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+func (outbound *HTTPConnectOutbound) ListenUDP(ctx context.Context, target netip.AddrPort) (net.PacketConn, error) {
+	return nil, errors.New("http connect outbound doesn't support udp")
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (conn *bufferedConn) Read(p []byte) (int, error) {
+	return conn.reader.Read(p)
+}
+
+func (conn *bufferedConn) CloseWrite() error {
+	if cw, ok := conn.Conn.(interface{ CloseWrite() error }); ok {
+		return cw.CloseWrite()
+	}
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,304 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/netip"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	socksVersion5 = 0x05
+
+	socksMethodNoAuth       = 0x00
+	socksMethodUserPass     = 0x02
+	socksMethodNoAcceptable = 0xff
+
+	socksCmdConnect      = 0x01
+	socksCmdUDPAssociate = 0x03
+
+	socksAtypIPv4   = 0x01
+	socksAtypDomain = 0x03
+	socksAtypIPv6   = 0x04
+
+	socksReplySucceeded          = 0x00
+	socksReplyNotAllowed         = 0x02
+	socksReplyNetworkUnreachable = 0x03
+	socksReplyHostUnreachable    = 0x04
+	socksReplyConnectionRefused  = 0x05
+	socksReplyTTLExpired         = 0x06
+)
+
+var socksReplyMessages = map[byte]string{
+	0x01:                         "general failure",
+	socksReplyNotAllowed:         "connection not allowed by ruleset",
+	socksReplyNetworkUnreachable: "network unreachable",
+	socksReplyHostUnreachable:    "host unreachable",
+	socksReplyConnectionRefused:  "connection refused",
+	socksReplyTTLExpired:         "ttl expired",
+	0x07:                         "command not supported",
+	0x08:                         "address type not supported",
+}
+
+// socksReplyError is a failure reply of the upstream SOCKS5 server.
+type socksReplyError struct {
+	reply byte
+}
+
+func (err *socksReplyError) Error() string {
+	message, found := socksReplyMessages[err.reply]
+	if !found {
+		message = "reply " + strconv.Itoa(int(err.reply))
+	}
+	return "upstream socks server: " + message
+}
+
+var _ Outbound = &SOCKS5Outbound{}
+
+// SOCKS5Outbound relays through an upstream SOCKS5 server, using UDP
+// ASSOCIATE for udp tunnels. HandshakeTimeout bounds the negotiation with the
+// upstream, defaultHandshakeTimeout when zero.
+type SOCKS5Outbound struct {
+	Address          string
+	Username         string
+	Password         string
+	Dialer           *net.Dialer
+	HandshakeTimeout time.Duration
+}
+
+func (outbound *SOCKS5Outbound) DialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	conn, _, err := outbound.request(ctx, socksCmdConnect, addr)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+func (outbound *SOCKS5Outbound) ListenUDP(ctx context.Context, target netip.AddrPort) (net.PacketConn, error) {
+	control, relay, err := outbound.request(ctx, socksCmdUDPAssociate, netip.AddrPortFrom(netip.IPv4Unspecified(), 0))
+	if err != nil {
+		return nil, err
+	}
+
+	// Servers may answer with an unspecified address meaning "the address you
+	// reached me on".
+	if relay.Addr().IsUnspecified() {
+		remote, _ := netip.ParseAddrPort(control.RemoteAddr().String())
+		relay = netip.AddrPortFrom(remote.Addr(), relay.Port())
+	}
+
+	lc := net.ListenConfig{}
+	udpConn, err := lc.ListenPacket(ctx, "udp", "")
+	if err != nil {
+		control.Close()
+		return nil, err
+	}
+
+	conn := &socksPacketConn{
+		PacketConn: udpConn,
+		control:    control,
+		relay:      net.UDPAddrFromAddrPort(relay),
+	}
+	// The association lives as long as the control connection.
+	go func() {
+		io.Copy(io.Discard, control)
+		conn.Close()
+	}()
+	return conn, nil
+}
+
+func (outbound *SOCKS5Outbound) request(ctx context.Context, cmd byte, addr netip.AddrPort) (net.Conn, netip.AddrPort, error) {
+	dialer := outbound.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	conn, err := dialer.DialContext(ctx, "tcp", outbound.Address)
+	if err != nil {
+		return nil, netip.AddrPort{}, err
+	}
+
+	conn.SetDeadline(handshakeDeadline(ctx, outbound.HandshakeTimeout))
+
+	bind, err := outbound.handshake(conn, cmd, addr)
+	if err != nil {
+		conn.Close()
+		return nil, netip.AddrPort{}, err
+	}
+
+	conn.SetDeadline(time.Time{})
+	return conn, bind, nil
+}
+
+func (outbound *SOCKS5Outbound) handshake(conn net.Conn, cmd byte, addr netip.AddrPort) (netip.AddrPort, error) {
+	method := byte(socksMethodNoAuth)
+	if outbound.Username != "" || outbound.Password != "" {
+		method = socksMethodUserPass
+	}
+	if _, err := conn.Write([]byte{socksVersion5, 1, method}); err != nil {
+		return netip.AddrPort{}, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if reply[0] != socksVersion5 || reply[1] == socksMethodNoAcceptable || reply[1] != method {
+		return netip.AddrPort{}, errors.New("upstream socks server rejected authentication method")
+	}
+
+	if method == socksMethodUserPass {
+		if len(outbound.Username) > 255 || len(outbound.Password) > 255 {
+			return netip.AddrPort{}, errors.New("socks credentials too long")
+		}
+		auth := []byte{0x01, byte(len(outbound.Username))}
+		auth = append(auth, outbound.Username...)
+		auth = append(auth, byte(len(outbound.Password)))
+		auth = append(auth, outbound.Password...)
+		if _, err := conn.Write(auth); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return netip.AddrPort{}, err
+		}
+		if reply[1] != 0x00 {
+			return netip.AddrPort{}, errors.New("upstream socks authentication failed")
+		}
+	}
+
+	if _, err := conn.Write(appendSOCKSAddrPort([]byte{socksVersion5, cmd, 0x00}, addr)); err != nil {
+		return netip.AddrPort{}, err
+	}
+
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return netip.AddrPort{}, err
+	}
+	if header[1] != socksReplySucceeded {
+		return netip.AddrPort{}, &socksReplyError{reply: header[1]}
+	}
+	bind, _, err := readSOCKSAddrPort(conn)
+	return bind, err
+}
+
+func appendSOCKSAddrPort(data []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	if ip.Is4() {
+		data = append(data, socksAtypIPv4)
+	} else {
+		data = append(data, socksAtypIPv6)
+	}
+	data = append(data, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(data, addr.Port())
+}
+
+// readSOCKSAddrPort reads an address in SOCKS5 wire format. Domain names are
+// returned as domain with an invalid AddrPort.
+func readSOCKSAddrPort(r io.Reader) (addr netip.AddrPort, domain string, err error) {
+	atyp := make([]byte, 1)
+	if _, err := io.ReadFull(r, atyp); err != nil {
+		return netip.AddrPort{}, "", err
+	}
+
+	var ip netip.Addr
+	switch atyp[0] {
+	case socksAtypIPv4:
+		b := make([]byte, 4)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return netip.AddrPort{}, "", err
+		}
+		ip = netip.AddrFrom4([4]byte(b))
+	case socksAtypIPv6:
+		b := make([]byte, 16)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return netip.AddrPort{}, "", err
+		}
+		ip = netip.AddrFrom16([16]byte(b))
+	case socksAtypDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(r, length); err != nil {
+			return netip.AddrPort{}, "", err
+		}
+		b := make([]byte, length[0])
+		if _, err := io.ReadFull(r, b); err != nil {
+			return netip.AddrPort{}, "", err
+		}
+		domain = string(b)
+	default:
+		return netip.AddrPort{}, "", errors.New("unsupported socks address type " + strconv.Itoa(int(atyp[0])))
+	}
+
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return netip.AddrPort{}, "", err
+	}
+	if domain != "" {
+		return netip.AddrPort{}, domain, nil
+	}
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16(port)), "", nil
+}
+
+// socksPacketConn wraps datagrams in SOCKS5 UDP request headers and sends
+// them through the relay the upstream server assigned.
+type socksPacketConn struct {
+	net.PacketConn
+	control   net.Conn
+	relay     *net.UDPAddr
+	closeOnce sync.Once
+
+	readMutex sync.Mutex
+	readBuf   []byte
+}
+
+func (conn *socksPacketConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	conn.readMutex.Lock()
+	defer conn.readMutex.Unlock()
+	if len(conn.readBuf) < len(p)+262 {
+		conn.readBuf = make([]byte, len(p)+262)
+	}
+	buf := conn.readBuf
+	for {
+		n, from, err := conn.PacketConn.ReadFrom(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if fromUDP, ok := from.(*net.UDPAddr); !ok || !fromUDP.IP.Equal(conn.relay.IP) {
+			continue
+		}
+		if n < 4 || buf[2] != 0x00 {
+			continue
+		}
+		reader := bytes.NewReader(buf[3:n])
+		addr, _, err := readSOCKSAddrPort(reader)
+		if err != nil || !addr.IsValid() {
+			continue
+		}
+		return copy(p, buf[n-reader.Len():n]), net.UDPAddrFromAddrPort(addr), nil
+	}
+}
+
+func (conn *socksPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	addrPort, err := netip.ParseAddrPort(addr.String())
+	if err != nil {
+		return 0, err
+	}
+	packet := appendSOCKSAddrPort([]byte{0x00, 0x00, 0x00}, addrPort)
+	packet = append(packet, p...)
+	if _, err := conn.PacketConn.WriteTo(packet, conn.relay); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (conn *socksPacketConn) Close() error {
+	var err error
+	conn.closeOnce.Do(func() {
+		conn.control.Close()
+		err = conn.PacketConn.Close()
+	})
+	return err
+}
@@ -0,0 +1,24 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+
+	"github.com/b00tkitism/wsc/client"
+)
+
+var _ Outbound = &WSCOutbound{}
+
+// WSCOutbound chains through another wsc server.
+type WSCOutbound struct {
+	Dialer *client.Dialer
+}
+
+func (outbound *WSCOutbound) DialTCP(ctx context.Context, addr netip.AddrPort) (net.Conn, error) {
+	return outbound.Dialer.DialContext(ctx, "tcp", addr.String())
+}
+
+func (outbound *WSCOutbound) ListenUDP(ctx context.Context, target netip.AddrPort) (net.PacketConn, error) {
+	return outbound.Dialer.ListenPacket(ctx, "udp", target.String())
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"net/netip"
+	"slices"
+	"strings"
+)
+
+type PolicyAction int
+
+const (
+	PolicyDeny PolicyAction = iota
+	PolicyAllow
+)
+
+type PortRange struct {
+	From uint16
+	To   uint16
+}
+
+func (r PortRange) Contains(port uint16) bool {
+	return port >= r.From && port <= r.To
+}
+
+// DestinationRule matches a destination when every non-empty criterion
+// matches. Domains match the name the client asked for and all of its
+// subdomains; IP literals never match a domain rule.
+type DestinationRule struct {
+	Action   PolicyAction
+	Prefixes []netip.Prefix
+	Ports    []PortRange
+	Domains  []string
+}
+
+func (rule *DestinationRule) matches(host string, addr netip.AddrPort) bool {
+	if len(rule.Prefixes) > 0 && !slices.ContainsFunc(rule.Prefixes, func(prefix netip.Prefix) bool {
+		return prefix.Contains(addr.Addr())
+	}) {
+		return false
+	}
+	if len(rule.Ports) > 0 && !slices.ContainsFunc(rule.Ports, func(r PortRange) bool {
+		return r.Contains(addr.Port())
+	}) {
+		return false
+	}
+	if len(rule.Domains) > 0 && !slices.ContainsFunc(rule.Domains, func(domain string) bool {
+		return domainMatches(domain, host)
+	}) {
+		return false
+	}
+	return true
+}
+
+// DestinationPolicy decides which resolved addresses users may reach. Rules
+// are evaluated in order and the first match wins; Default applies otherwise.
+type DestinationPolicy struct {
+	Rules   []DestinationRule
+	Default PolicyAction
+}
+
+// DefaultDestinationPolicy allows everything except loopback, private,
+// link-local (including cloud metadata endpoints), benchmarking, reserved,
+// multicast and unspecified addresses and local-use NAT64. Check applies it
+// to the IPv4 address inside NAT64 and 6to4 addresses too.
+func DefaultDestinationPolicy() *DestinationPolicy {
+	return &DestinationPolicy{
+		Rules: []DestinationRule{
+			{
+				Action: PolicyDeny,
+				Prefixes: []netip.Prefix{
+					netip.MustParsePrefix("0.0.0.0/8"),
+					netip.MustParsePrefix("10.0.0.0/8"),
+					netip.MustParsePrefix("100.64.0.0/10"),
+					netip.MustParsePrefix("127.0.0.0/8"),
+					netip.MustParsePrefix("169.254.0.0/16"),
+					netip.MustParsePrefix("172.16.0.0/12"),
+					netip.MustParsePrefix("192.168.0.0/16"),
+					netip.MustParsePrefix("198.18.0.0/15"),
+					netip.MustParsePrefix("224.0.0.0/4"),
+					netip.MustParsePrefix("240.0.0.0/4"),
+					netip.MustParsePrefix("::/128"),
+					netip.MustParsePrefix("::1/128"),
+					netip.MustParsePrefix("64:ff9b:1::/48"),
+					netip.MustParsePrefix("fc00::/7"),
+					netip.MustParsePrefix("fe80::/10"),
+					netip.MustParsePrefix("ff00::/8"),
+				},
+			},
+		},
+		Default: PolicyAllow,
+	}
+}
+
+var defaultDestinationPolicy = DefaultDestinationPolicy()
+
+var (
+	nat64Prefix = netip.MustParsePrefix("64:ff9b::/96")
+	sixToFour   = netip.MustParsePrefix("2002::/16")
+)
+
+// embeddedIPv4 returns the IPv4 address a NAT64 or 6to4 address ends up at.
+func embeddedIPv4(addr netip.Addr) (netip.Addr, bool) {
+	b := addr.As16()
+	switch {
+	case nat64Prefix.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[12:16])), true
+	case sixToFour.Contains(addr):
+		return netip.AddrFrom4([4]byte(b[2:6])), true
+	}
+	return netip.Addr{}, false
+}
+
+// DeniedError is returned when a destination is rejected by policy.
+type DeniedError struct {
+	Destination string
+}
+
+func (err *DeniedError) Error() string {
+	return "destination denied by policy: " + err.Destination
+}
+
+// Check evaluates userRules before the policy's own rules. host is the name
+// the client asked for and addr the address it resolved to. NAT64 and 6to4
+// addresses must be allowed both as they are and as the IPv4 address they
+// embed.
+func (policy *DestinationPolicy) Check(userRules []DestinationRule, host string, addr netip.AddrPort) error {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap().WithZone(""), addr.Port())
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	action := policy.action(userRules, host, addr)
+	if v4, ok := embeddedIPv4(addr.Addr()); ok && action == PolicyAllow {
+		action = policy.action(userRules, host, netip.AddrPortFrom(v4, addr.Port()))
+	}
+
+	if action != PolicyAllow {
+		destination := addr.String()
+		if host != "" && host != addr.Addr().String() {
+			destination = host + " (" + destination + ")"
+		}
+		return &DeniedError{Destination: destination}
+	}
+	return nil
+}
+
+// action returns the action of the first rule matching addr.
+func (policy *DestinationPolicy) action(userRules []DestinationRule, host string, addr netip.AddrPort) PolicyAction {
+	for _, rules := range [][]DestinationRule{userRules, policy.Rules} {
+		for i := range rules {
+			if rules[i].matches(host, addr) {
+				return rules[i].Action
+			}
+		}
+	}
+	return policy.Default
+}
+
+func domainMatches(domain string, host string) bool {
+	domain = strings.TrimPrefix(strings.TrimPrefix(strings.ToLower(domain), "*"), ".")
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || host == "" {
+		return false
+	}
+	return host == domain || strings.HasSuffix(host, "."+domain)
+}
+
+func (pro *Proxy) checkDestination(user *User, host string, addr netip.AddrPort) error {
+	policy := pro.DestinationPolicy
+	if policy == nil {
+		policy = defaultDestinationPolicy
+	}
+	return policy.Check(user.DestinationRules(), host, addr)
+}
+
+func (pro *Proxy) destinationChecker(user *User) func(host string, addr netip.AddrPort) error {
+	return func(host string, addr netip.AddrPort) error {
+		return pro.checkDestination(user, host, addr)
+	}
+}
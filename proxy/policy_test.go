@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"net/netip"
+	"testing"
+)
+
+func TestDefaultDestinationPolicy(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"1.1.1.1:443", true},
+		{"[2606:4700::1111]:443", true},
+		{"0.0.0.0:80", false},
+		{"10.1.2.3:22", false},
+		{"100.64.0.1:80", false},
+		{"127.0.0.1:22", false},
+		{"169.254.169.254:80", false},
+		{"172.16.0.1:80", false},
+		{"192.168.1.1:80", false},
+		{"198.18.0.1:80", false},
+		{"198.19.255.255:80", false},
+		{"198.20.0.1:80", true},
+		{"224.0.0.1:80", false},
+		{"240.0.0.1:80", false},
+		{"255.255.255.255:80", false},
+		{"[::]:80", false},
+		{"[::1]:22", false},
+		{"[::ffff:127.0.0.1]:22", false},
+		{"[fd00::1]:80", false},
+		{"[fe80::1%eth0]:80", false},
+		{"[ff02::1]:80", false},
+		// NAT64 and 6to4 are judged by the IPv4 address they embed.
+		{"[64:ff9b::7f00:1]:22", false},
+		{"[64:ff9b::a00:1]:22", false},
+		{"[64:ff9b::101:101]:443", true},
+		{"[64:ff9b:1::1]:80", false},
+		{"[2002:7f00:1::1]:22", false},
+		{"[2002:c0a8:101::1]:80", false},
+		{"[2002:101:101::1]:443", true},
+	}
+
+	policy := DefaultDestinationPolicy()
+	for _, test := range tests {
+		err := policy.Check(nil, "", netip.MustParseAddrPort(test.addr))
+		if allowed := err == nil; allowed != test.allowed {
+			t.Errorf("Check(%s) allowed = %v, want %v (err: %v)", test.addr, allowed, test.allowed, err)
+		}
+	}
+}
+
+func TestDestinationPolicyRules(t *testing.T) {
+	policy := &DestinationPolicy{
+		Rules: []DestinationRule{
+			{Action: PolicyAllow, Domains: []string{"intranet.example"}, Ports: []PortRange{{From: 443, To: 443}}},
+			{Action: PolicyDeny, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.0.0.0/8")}},
+			{Action: PolicyDeny, Domains: []string{"*.blocked.example"}},
+			{Action: PolicyDeny, Ports: []PortRange{{From: 25, To: 25}}},
+		},
+		Default: PolicyAllow,
+	}
+	userRules := []DestinationRule{
+		{Action: PolicyAllow, Prefixes: []netip.Prefix{netip.MustParsePrefix("10.9.0.0/16")}},
+		{Action: PolicyDeny, Domains: []string{"social.example"}},
+	}
+
+	tests := []struct {
+		name      string
+		userRules []DestinationRule
+		host      string
+		addr      string
+		allowed   bool
+	}{
+		{"default", nil, "example.com", "93.184.216.34:443", true},
+		{"prefix", nil, "", "10.1.1.1:80", false},
+		{"domain before prefix", nil, "intranet.example", "10.1.1.1:443", true},
+		{"domain port mismatch", nil, "intranet.example", "10.1.1.1:80", false},
+		{"subdomain", nil, "intranet.example.", "10.1.1.1:443", true},
+		{"wildcard", nil, "a.b.blocked.example", "1.2.3.4:443", false},
+		{"wildcard apex", nil, "BLOCKED.example", "1.2.3.4:443", false},
+		{"suffix only", nil, "notblocked.example", "1.2.3.4:443", true},
+		{"port", nil, "", "1.2.3.4:25", false},
+		{"ip literal ignores domains", nil, "1.2.3.4", "1.2.3.4:443", true},
+		{"user allow first", userRules, "", "10.9.1.1:80", true},
+		{"user deny", userRules, "www.social.example", "1.2.3.4:443", false},
+		{"user rules fall through", userRules, "", "10.8.1.1:80", false},
+		{"mapped address", nil, "", "[::ffff:10.1.1.1]:80", false},
+		{"nat64 embedded", nil, "", "[64:ff9b::a01:101]:80", false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := policy.Check(test.userRules, test.host, netip.MustParseAddrPort(test.addr))
+			if allowed := err == nil; allowed != test.allowed {
+				t.Errorf("Check(%q, %s) allowed = %v, want %v (err: %v)", test.host, test.addr, allowed, test.allowed, err)
+			}
+		})
+	}
+}
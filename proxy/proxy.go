@@ -12,63 +12,156 @@ import (
 	"sync"
 	"time"
 
+	"github.com/b00tkitism/wsc/protocol"
 	"github.com/gobwas/ws"
 	"github.com/gobwas/ws/wsutil"
+	"github.com/itsabgr/ge"
 	"golang.org/x/sync/errgroup"
 )
 
 var _ http.Handler = &Proxy{}
 
-type Authenticator interface {
-	Authenticate(ctx context.Context, auth string) (int64, int64, error)
-	ReportUsage(ctx context.Context, id int64, usedTraffic int64) error
-}
-
 type Proxy struct {
 	MaximumConnectionsPerUser  int
 	UsageReportTimeInterval    time.Duration
 	UsageReportTrafficInterval int64
+	MaximumMuxStreams          int
+	RateLimitBurst             int64
 	Users                      map[int64]*User
-	Auth                       Authenticator
-
-	ipResolver *net.Resolver
-	dialer     *net.Dialer
-	userMutex  sync.Mutex
+	Auth                       SessionAuthenticator
+
+	// DestinationPolicy guards which addresses users may reach. A nil policy
+	// falls back to DefaultDestinationPolicy.
+	DestinationPolicy *DestinationPolicy
+
+	// Outbound carries traffic to the destinations, DirectOutbound when nil.
+	// Outbounds holds the alternatives an AuthResult may select by name.
+	Outbound  Outbound
+	Outbounds map[string]Outbound
+
+	// Resolver looks up destination names. NewProxy sets a CachingResolver
+	// over the system resolver.
+	Resolver Resolver
+
+	// FamilyPreference orders and filters resolved destination addresses
+	// unless the AuthResult asks for something else.
+	FamilyPreference FamilyPreference
+
+	// CountFrameOverhead bills WebSocket frame headers and wsc's own framing
+	// (UDP address headers, mux frames) on top of the relayed payload.
+	CountFrameOverhead bool
+
+	// DestinationUsageSink receives a per-destination breakdown next to each
+	// usage report, limited to the DestinationUsageTopN busiest destinations
+	// of the user. Nil disables the breakdown.
+	DestinationUsageSink DestinationUsageSink
+	DestinationUsageTopN int
+
+	// DisableQueryAuth rejects tokens sent in the ?auth= query string, which
+	// tends to leak into reverse-proxy and CDN access logs.
+	DisableQueryAuth bool
+
+	// UDPFiltering picks which hosts may answer through a net=udp session.
+	// UDPPinEndpoint limits the session to the addresses of its ep, and
+	// UDPMaxDestinations caps how many distinct destinations it may talk to
+	// at once. A session without traffic for UDPIdleTimeout is closed, which
+	// also expires its destinations. Zero disables the cap and the timeout.
+	UDPFiltering       UDPFiltering
+	UDPPinEndpoint     bool
+	UDPMaxDestinations int
+	UDPIdleTimeout     time.Duration
+
+	userMutex sync.Mutex
+
+	journal     *UsageJournal
+	journalStop context.CancelFunc
+	journalDone chan struct{}
+
+	lifecycleMutex  sync.Mutex
+	closing         bool
+	handlerWG       sync.WaitGroup
+	reportWG        sync.WaitGroup
+	reportsClosed   bool
+	unreportedUsers map[*User]struct{}
+
+	inFlightMutex sync.Mutex
+	inFlight      map[int64]int64
+
+	metrics proxyMetrics
 }
 
-func NewProxy(authenticator Authenticator, maximumConnectionsPerUser int, usageReportTimeInterval time.Duration, usageReportTrafficInterval int64) *Proxy {
+func NewProxy(authenticator SessionAuthenticator, maximumConnectionsPerUser int, usageReportTimeInterval time.Duration, usageReportTrafficInterval int64) *Proxy {
 	return &Proxy{
 		MaximumConnectionsPerUser:  maximumConnectionsPerUser,
 		UsageReportTimeInterval:    usageReportTimeInterval,
 		UsageReportTrafficInterval: usageReportTrafficInterval,
+		MaximumMuxStreams:          256,
+		DestinationUsageTopN:       32,
+		UDPMaxDestinations:         64,
+		UDPIdleTimeout:             time.Minute * 2,
 		Users:                      map[int64]*User{},
 		Auth:                       authenticator,
-		ipResolver:                 &net.Resolver{},
-		dialer:                     &net.Dialer{},
+		DestinationPolicy:          DefaultDestinationPolicy(),
+		unreportedUsers:            map[*User]struct{}{},
+		Resolver:                   NewCachingResolver(&SystemResolver{}),
+		Outbound:                   &DirectOutbound{},
+		Outbounds:                  map[string]Outbound{},
 	}
 }
 
 func (pro *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 	ctx := request.Context()
+	hs := negotiate(request)
+
+	if !pro.acquireHandler() {
+		pro.reject(writer, request, hs, protocol.CloseServerShutdown, http.StatusServiceUnavailable, "Server is shutting down")
+		slog.Debug("Request failed. Server is shutting down.", slog.String("client", request.RemoteAddr))
+		return
+	}
+	defer pro.handlerWG.Done()
 
-	auth := request.URL.Query().Get("auth")
+	auth, authSource := pro.requestToken(request)
 	if auth == "" {
+		pro.handshakeFailed(failureAuth)
+		if authSource == "query" {
+			http.Error(writer, "Query string authentication is disabled", http.StatusBadRequest)
+			slog.Debug("Request failed. Query string authentication is disabled.", slog.String("client", request.RemoteAddr))
+			return
+		}
 		http.Error(writer, "Authentication required", http.StatusBadRequest)
 		slog.Debug("Request failed. Authentication required.", slog.String("client", request.RemoteAddr))
 		return
 	}
 
-	uid, rate, err := pro.Auth.Authenticate(ctx, auth)
+	result, err := pro.Auth.AuthenticateSession(ctx, auth)
 	if err != nil {
-		if uid != 0 {
-			if err := pro.cleanupUser(ctx, uid, false); err != nil {
-				slog.Debug("Request failed. Couldn't cleanup user: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
+		pro.handshakeFailed(failureAuth)
+		if result != nil && result.UserID != 0 {
+			if err := pro.cleanupUser(ctx, result.UserID, false); err != nil {
+				slog.Debug("Request failed. Couldn't cleanup user: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", result.UserID))
 			}
 		}
 		http.Error(writer, "Authentication failed: "+err.Error(), http.StatusBadRequest)
 		slog.Debug("Request failed. Authentication failed: "+err.Error(), slog.String("client", request.RemoteAddr))
 		return
 	}
+	if result == nil {
+		pro.handshakeFailed(failureAuth)
+		http.Error(writer, "Authentication failed", http.StatusBadRequest)
+		slog.Debug("Request failed. Authenticator returned no result.", slog.String("client", request.RemoteAddr))
+		return
+	}
+	uid := result.UserID
+
+	if result.Expired(time.Now()) {
+		pro.handshakeFailed(failureAuth)
+		if err := pro.cleanupUser(ctx, uid, false); err != nil {
+			slog.Debug("Request failed. Couldn't cleanup user: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
+		}
+		http.Error(writer, "Account expired", http.StatusForbidden)
+		slog.Debug("Request failed. Account expired.", slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
+		return
+	}
 
 	if request.Method == "POST" && request.URL.Path == "/cleanup" {
 		if err := pro.cleanupUser(ctx, uid, true); err != nil {
@@ -80,31 +173,93 @@ func (pro *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 
-	user := pro.findUser(ctx, uid, rate)
-
-	network := request.URL.Query().Get("net")
+	network := request.URL.Query().Get(protocol.NetworkQueryParam)
 	if network == "" {
 		network = "tcp"
 	}
+	switch network {
+	case "tcp", "udp", "mux":
+	default:
+		pro.handshakeFailed(failureEndpoint)
+		http.Error(writer, "Unknown network: "+network, http.StatusBadRequest)
+		slog.Debug("Request failed. Unknown network.", slog.String("client", request.RemoteAddr), slog.String("net", network))
+		return
+	}
+	if !result.AllowsNetwork(network) {
+		pro.handshakeFailed(failurePolicy)
+		pro.reject(writer, request, hs, protocol.ClosePolicyDenied, http.StatusForbidden, "Network not allowed: "+network)
+		slog.Debug("Request failed. Network not allowed.", slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid), slog.String("net", network))
+		return
+	}
+
+	user := pro.findUser(ctx, result)
+	if remaining, ok := user.RemainingBytes(); ok && remaining <= 0 {
+		pro.handshakeFailed(failureQuota)
+		pro.reject(writer, request, hs, protocol.CloseQuotaExceeded, http.StatusForbidden, "Traffic quota exceeded")
+		slog.Debug("Request failed. Traffic quota exceeded.", slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
+		return
+	}
 
-	endpoint := request.URL.Query().Get("ep")
-	// tcpAddr, err := parseEndpointTCP(ctx, pro.ipResolver, endpoint)
-	addr, err := parseEndpointAddr(ctx, pro.ipResolver, endpoint)
+	outbound, err := pro.userOutbound(user)
 	if err != nil {
-		http.Error(writer, "Failed to parse endpoint: "+err.Error(), http.StatusBadRequest)
-		slog.Debug("Request failed. Failed to parse endpoint: "+err.Error(), slog.String("client", request.RemoteAddr), slog.String("net", network))
+		pro.handshakeFailed(failureDial)
+		http.Error(writer, "Failed to select outbound: "+err.Error(), http.StatusInternalServerError)
+		slog.Error("Request failed. Failed to select outbound: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
 		return
 	}
 
-	slog.Debug("New request", slog.String("client", request.RemoteAddr), slog.String("auth", auth), slog.Int64("user-id", uid), slog.String(network+"-addr", addr.ip.String()+":"+strconv.Itoa(int(addr.port))))
+	ctx = ContextWithEgress(ctx, EgressInfo{UserID: uid, SourceAddrs: result.SourceAddrs})
+
+	var target *tunnelTarget
+	if network == "mux" {
+		slog.Debug("New request", slog.String("client", request.RemoteAddr), slog.String("auth", redactToken(auth)), slog.String("auth-source", authSource), slog.Int64("user-id", uid), slog.String("net", network))
+	} else {
+		endpoint := request.URL.Query().Get(protocol.EndpointQueryParam)
+		addr, err := parseEndpointAddr(ctx, pro.resolver(), endpoint, pro.familyPreference(user), pro.destinationChecker(user))
+		if err != nil {
+			if _, ok := ge.As[*DeniedError](err); ok {
+				pro.handshakeFailed(failurePolicy)
+				pro.reject(writer, request, hs, protocol.ClosePolicyDenied, http.StatusForbidden, err.Error())
+				slog.Debug("Request failed. "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid), slog.String("net", network))
+				return
+			}
+			pro.handshakeFailed(failureEndpoint)
+			if _, ok := ge.As[*resolveError](err); ok {
+				pro.reject(writer, request, hs, protocol.CloseDNSFailure, http.StatusBadRequest, "Failed to parse endpoint: "+err.Error())
+			} else {
+				http.Error(writer, "Failed to parse endpoint: "+err.Error(), http.StatusBadRequest)
+			}
+			slog.Debug("Request failed. Failed to parse endpoint: "+err.Error(), slog.String("client", request.RemoteAddr), slog.String("net", network))
+			return
+		}
 
-	conn, _, _, err := ws.UpgradeHTTP(request, writer)
+		slog.Debug("New request", slog.String("client", request.RemoteAddr), slog.String("auth", redactToken(auth)), slog.String("auth-source", authSource), slog.Int64("user-id", uid), slog.String(network+"-addr", addr.addrPort().String()), slog.Int("addr-count", len(addr.addrs)))
+
+		target, err = pro.dialTarget(ctx, outbound, network, addr)
+		if err != nil {
+			pro.handshakeFailed(failureDial)
+			pro.reject(writer, request, hs, dialCloseCode(err), http.StatusBadGateway, "Failed to dial endpoint: "+err.Error())
+			slog.Debug("Request failed. Failed to dial endpoint: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid), slog.String("net", network))
+			return
+		}
+		defer target.Close()
+	}
+
+	upgrader := hs.upgrader()
+	conn, _, _, err := upgrader.Upgrade(request, writer)
 	if err != nil {
-		http.Error(writer, "WebSocket upgrade failed: "+err.Error(), http.StatusBadRequest)
+		pro.handshakeFailed(failureUpgrade)
+		if conn != nil {
+			conn.Close()
+		}
 		slog.Debug("Failed to upgrade WebSocket: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
 		return
 	}
 
+	connections := pro.metrics.connections.with(network)
+	connections.Add(1)
+	defer connections.Add(-1)
+
 	defer func() {
 		if err := pro.cleanupUserConn(ctx, user, conn); err != nil {
 			slog.Error("Failed to cleanup user connection: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
@@ -114,95 +269,138 @@ func (pro *Proxy) ServeHTTP(writer http.ResponseWriter, request *http.Request) {
 		}
 	}()
 
-	if err := pro.pipeConn(ctx, user, conn, network, addr); err != nil {
+	if err := pro.pipeConn(ctx, user, outbound, conn, network, target, hs); err != nil {
 		slog.Debug("Failed to pipe connection: "+err.Error(), slog.String("client", request.RemoteAddr), slog.Int64("user-id", uid))
-		http.Error(writer, "Failed to pipe connection: "+err.Error(), http.StatusInternalServerError)
 	}
 }
 
-func (pro *Proxy) pipeConn(ctx context.Context, user *User, conn net.Conn, network string, target *endpointAddr) error {
-	if poppedConn, err := user.AddConn(conn); err != nil {
+// tunnelTarget is the far side of a tcp or udp tunnel. It is connected before
+// the upgrade, so a failed dial can still be told to the client.
+type tunnelTarget struct {
+	addr    *endpointAddr
+	tcpConn net.Conn
+	udpConn net.PacketConn
+}
+
+func (pro *Proxy) dialTarget(ctx context.Context, outbound Outbound, network string, addr *endpointAddr) (*tunnelTarget, error) {
+	if network == "udp" {
+		udpConn, err := outbound.ListenUDP(ctx, addr.addrPort())
+		if err != nil {
+			return nil, err
+		}
+		return &tunnelTarget{addr: addr, udpConn: udpConn}, nil
+	}
+
+	dialStart := time.Now()
+	tcpConn, err := dialHappyEyeballs(ctx, outbound, addr.addrPorts())
+	pro.metrics.dialDuration.with("tcp").observe(time.Since(dialStart))
+	if err != nil {
+		return nil, err
+	}
+	return &tunnelTarget{addr: addr, tcpConn: tcpConn}, nil
+}
+
+func (target *tunnelTarget) Close() error {
+	if target.udpConn != nil {
+		return target.udpConn.Close()
+	}
+	return target.tcpConn.Close()
+}
+
+func (pro *Proxy) pipeConn(ctx context.Context, user *User, outbound Outbound, conn net.Conn, network string, target *tunnelTarget, hs handshake) error {
+	pro.userMutex.Lock()
+	poppedConn, err := user.AddConn(conn)
+	// Shutdown terminates every user under userMutex once closing is set, so
+	// a conn added after that has to close on its own.
+	closing := pro.isClosing()
+	pro.userMutex.Unlock()
+	if err != nil {
 		return err
+	}
+	if poppedConn != nil {
+		pro.metrics.evictions.Add(1)
+	}
+	if closing {
+		conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		wsutil.WriteServerMessage(conn, ws.OpClose, closeFrameBody(protocol.CloseServerShutdown, "server shutdown"))
+		return errors.New("server is shutting down")
+	}
+	if target != nil {
+		user.describeConn(conn, network, target.addr.String())
 	} else {
-		if poppedConn != nil {
-			poppedConn.Close()
-		}
+		user.describeConn(conn, network, "")
 	}
 
 	switch network {
 	case "tcp":
 		{
-			tcpAddr := &net.TCPAddr{
-				IP:   target.ip,
-				Port: int(target.port),
-				Zone: target.zone,
-			}
-			tcpConn, err := pro.dialer.DialContext(ctx, "tcp", tcpAddr.String())
-			if err != nil {
-				return err
-			}
-			defer tcpConn.Close()
+			tcpConn := target.tcpConn
+			destination := target.addr.String()
+			user.destinations.open(destination)
+			defer func(start time.Time) {
+				user.destinations.close(destination, time.Since(start))
+			}(time.Now())
 
 			eg, ctx := errgroup.WithContext(ctx)
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 
+			hc := &halfCloser{enabled: hs.capabilities.Has(protocol.CapHalfClose), cancel: cancel}
 			eg.Go(func() error {
-				return pro.pipeWSToTCP(ctx, user, conn, tcpConn)
+				// The client closing its WebSocket ends both directions.
+				defer cancel()
+				return pro.pipeWSToTCP(ctx, user, conn, tcpConn, destination, hc)
 			})
 			eg.Go(func() error {
-				err := pro.pipeTCPToWS(ctx, user, tcpConn, conn)
-				cancel()
-				return err
+				return pro.pipeTCPToWS(ctx, user, tcpConn, conn, destination, hc)
 			})
 
 			return eg.Wait()
 		}
 	case "udp":
 		{
-			udpAddr := &net.UDPAddr{
-				IP:   target.ip,
-				Port: int(target.port),
-				Zone: target.zone,
-			}
-			udpConn, err := net.ListenPacket("udp", "0.0.0.0:0")
-			if err != nil {
-				return err
-			}
-			defer udpConn.Close()
+			udpConn, addr := target.udpConn, target.addr
+			user.destinations.open(addr.String())
+			defer func(start time.Time) {
+				user.destinations.close(addr.String(), time.Since(start))
+			}(time.Now())
 
 			eg, ctx := errgroup.WithContext(ctx)
 			ctx, cancel := context.WithCancel(ctx)
 			defer cancel()
 
+			session := pro.newUDPSession(addr, hs)
 			eg.Go(func() error {
-				return pro.pipeWSToUDP(ctx, user, conn, udpConn, udpAddr)
+				defer cancel()
+				return pro.pipeWSToUDP(ctx, user, conn, udpConn, addr, session)
 			})
 			eg.Go(func() error {
-				err := pro.pipeUDPToWS(ctx, user, udpConn, conn, udpAddr)
+				err := pro.pipeUDPToWS(ctx, user, udpConn, conn, addr, session)
 				cancel()
 				return err
 			})
 
 			return eg.Wait()
 		}
+	case "mux":
+		return pro.pipeMux(ctx, user, outbound, conn, hs)
 	default:
 		return errors.New("Unknown network to pipe: " + network)
 	}
 }
 
-func (pro *Proxy) pipeWSToUDP(ctx context.Context, user *User, wsConn net.Conn, udpConn net.PacketConn, udpAddr *net.UDPAddr) error {
+func (pro *Proxy) pipeWSToUDP(ctx context.Context, user *User, wsConn net.Conn, udpConn net.PacketConn, target *endpointAddr, session *udpSession) error {
 	wsLReader, err := user.ConnReader(wsConn)
 	if err != nil {
 		return err
 	}
-	wsWriter, err := user.ConnWriter(wsConn)
+	wsWriter, err := user.messageWriter(wsConn)
 	if err != nil {
 		return err
 	}
 
 	wsReader := wsutil.NewReader(wsLReader, ws.StateServerSide)
-	pack := user.InBuffer(wsConn)
+	pack := make([]byte, maxUDPMessageSize)
 
 	for {
 		if ctx.Err() != nil {
@@ -226,53 +424,89 @@ func (pro *Proxy) pipeWSToUDP(ctx context.Context, user *User, wsConn net.Conn,
 
 		switch header.OpCode {
 		case ws.OpPing:
-			wsutil.WriteServerMessage(wsWriter, ws.OpPong, nil)
+			wsWriter.WriteMessage(ws.OpPong, nil)
 			continue
 		case ws.OpPong:
 			continue
 		case ws.OpClose:
-			wsutil.WriteServerMessage(wsWriter, ws.OpClose, nil)
+			wsWriter.WriteMessage(ws.OpClose, nil)
 			return nil
 		}
 
-		for {
-			n, err := wsReader.Read(pack)
-			if n > 0 {
-				payload := packetConnPayload{}
-				if err := payload.UnmarshalBinaryUnsafe(pack[:n]); err != nil {
-					return err
-				}
+		if overhead := pro.clientFrameOverhead(header); overhead > 0 {
+			user.AddUpload(overhead)
+		}
 
-				if _, wErr := udpConn.WriteTo(payload.payload, net.UDPAddrFromAddrPort(payload.addrPort)); wErr != nil {
-					return wErr
-				} else {
-					user.UsedTrafficBytes.Add(int64(n))
-				}
+		if header.Length > maxUDPMessageSize {
+			slog.Debug("Dropped oversized UDP packet", slog.Int64("user-id", user.ID), slog.Int64("length", header.Length))
+			if _, err := io.Copy(io.Discard, wsReader); err != nil {
+				return err
 			}
-			if err != nil {
-				if errors.Is(err, io.EOF) {
-					break
-				}
+			continue
+		}
+		// A throttled datagram can take longer than the read deadline to
+		// arrive; keep reading it until the tunnel ends.
+		n := 0
+		for n < int(header.Length) {
+			m, err := wsReader.Read(pack[n:header.Length])
+			n += m
+			if err == nil || n == int(header.Length) {
+				continue
+			}
+			if errors.Is(err, io.EOF) {
+				return io.ErrUnexpectedEOF
+			}
+			if !isTimeoutErr(err) || ctx.Err() != nil {
+				return err
+			}
+			if err := wsConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
 				return err
 			}
 		}
+		frame, err := session.decodePacket(pack[:n])
+		if err != nil {
+			slog.Debug("Dropped malformed UDP packet: "+err.Error(), slog.Int64("user-id", user.ID))
+			continue
+		}
+
+		dst, pErr := pro.packetTarget(ctx, user, session, frame)
+		if pErr != nil {
+			slog.Debug("Dropped UDP packet: "+pErr.Error(), slog.Int64("user-id", user.ID))
+		} else if sErr := session.allowOutbound(dst, frame.Domain); sErr != nil {
+			slog.Debug("Dropped UDP packet: "+sErr.Error(), slog.Int64("user-id", user.ID))
+		} else if _, wErr := udpConn.WriteTo(frame.Payload, net.UDPAddrFromAddrPort(dst)); wErr != nil {
+			if errors.Is(wErr, net.ErrClosed) {
+				return wErr
+			}
+			slog.Debug("Dropped UDP packet: "+wErr.Error(), slog.Int64("user-id", user.ID))
+		} else {
+			destination := target.packetDestination(dst)
+			if frame.Domain != "" {
+				destination = frame.Host()
+			}
+			user.AddUpload(int64(len(frame.Payload)) + pro.frameOverhead(int64(n-len(frame.Payload))))
+			user.destinations.add(destination, int64(len(frame.Payload)), 0)
+		}
 	}
 }
 
-func (pro *Proxy) pipeUDPToWS(ctx context.Context, user *User, udpConn net.PacketConn, wsConn net.Conn, udpAddr *net.UDPAddr) error {
-	wsWriter, err := user.ConnWriter(wsConn)
+func (pro *Proxy) pipeUDPToWS(ctx context.Context, user *User, udpConn net.PacketConn, wsConn net.Conn, target *endpointAddr, session *udpSession) error {
+	wsWriter, err := user.messageWriter(wsConn)
 	if err != nil {
 		return err
 	}
 
-	pack := user.OutBuffer(wsConn)
-
-	payload := packetConnPayload{}
+	pack := make([]byte, maxUDPPayload)
 
 	for {
 		if ctx.Err() != nil {
 			return nil
 		}
+		if session.idle() {
+			slog.Debug("UDP session idle", slog.Int64("user-id", user.ID))
+			wsWriter.WriteMessage(ws.OpClose, ws.NewCloseFrameBody(ws.StatusNormalClosure, "idle timeout"))
+			return nil
+		}
 
 		if err := udpConn.SetReadDeadline(time.Now().Add(time.Second)); err != nil {
 			return err
@@ -289,27 +523,36 @@ func (pro *Proxy) pipeUDPToWS(ctx context.Context, user *User, udpConn net.Packe
 			return err
 		}
 
-		payload.addrPort = netip.MustParseAddrPort(netAddr.String())
-		payload.payload = pack[:n]
-		payloadBytes, err := payload.MarshalBinary()
+		src := netip.MustParseAddrPort(netAddr.String())
+		domain, allowed := session.allowInbound(src)
+		if !allowed {
+			slog.Debug("Dropped UDP packet from unknown peer", slog.Int64("user-id", user.ID), slog.String("peer", src.String()))
+			continue
+		}
+		payloadBytes, err := session.encodePacket(src, domain, pack[:n])
 		if err != nil {
 			return err
 		}
 
-		user.UsedTrafficBytes.Add(int64(n))
+		destination := target.packetDestination(src)
+		if domain != "" {
+			destination = net.JoinHostPort(domain, strconv.Itoa(int(src.Port())))
+		}
+		user.AddDownload(int64(n) + pro.frameOverhead(int64(len(payloadBytes)-n)) + pro.serverFrameOverhead(len(payloadBytes)))
+		user.destinations.add(destination, 0, int64(n))
 
-		if err := wsutil.WriteServerBinary(wsWriter, payloadBytes); err != nil {
+		if err := wsWriter.WriteMessage(ws.OpBinary, payloadBytes); err != nil {
 			return err
 		}
 	}
 }
 
-func (pro *Proxy) pipeWSToTCP(ctx context.Context, user *User, wsConn net.Conn, tcpConn net.Conn) error {
+func (pro *Proxy) pipeWSToTCP(ctx context.Context, user *User, wsConn net.Conn, tcpConn net.Conn, destination string, hc *halfCloser) error {
 	wsLReader, err := user.ConnReader(wsConn)
 	if err != nil {
 		return err
 	}
-	wsWriter, err := user.ConnWriter(wsConn)
+	wsWriter, err := user.messageWriter(wsConn)
 	if err != nil {
 		return err
 	}
@@ -339,13 +582,31 @@ func (pro *Proxy) pipeWSToTCP(ctx context.Context, user *User, wsConn net.Conn,
 
 		switch header.OpCode {
 		case ws.OpPing:
-			wsutil.WriteServerMessage(wsWriter, ws.OpPong, nil)
+			wsWriter.WriteMessage(ws.OpPong, nil)
 			continue
 		case ws.OpPong:
 			continue
 		case ws.OpClose:
-			wsutil.WriteServerMessage(wsWriter, ws.OpClose, nil)
+			wsWriter.WriteMessage(ws.OpClose, nil)
 			return nil
+		case ws.OpText:
+			if hc.enabled {
+				message, err := io.ReadAll(io.LimitReader(wsReader, header.Length))
+				if err != nil {
+					return err
+				}
+				if string(message) == protocol.HalfCloseMessage {
+					if err := closeWrite(tcpConn); err != nil {
+						return err
+					}
+					hc.finish()
+				}
+				continue
+			}
+		}
+
+		if overhead := pro.clientFrameOverhead(header); overhead > 0 {
+			user.AddUpload(overhead)
 		}
 
 		for {
@@ -354,7 +615,8 @@ func (pro *Proxy) pipeWSToTCP(ctx context.Context, user *User, wsConn net.Conn,
 				if _, wErr := tcpConn.Write(pack[:n]); wErr != nil {
 					return wErr
 				} else {
-					user.UsedTrafficBytes.Add(int64(n))
+					user.AddUpload(int64(n))
+					user.destinations.add(destination, int64(n), 0)
 				}
 			}
 			if err != nil {
@@ -367,8 +629,8 @@ func (pro *Proxy) pipeWSToTCP(ctx context.Context, user *User, wsConn net.Conn,
 	}
 }
 
-func (pro *Proxy) pipeTCPToWS(ctx context.Context, user *User, tcpConn net.Conn, wsConn net.Conn) error {
-	wsWriter, err := user.ConnWriter(wsConn)
+func (pro *Proxy) pipeTCPToWS(ctx context.Context, user *User, tcpConn net.Conn, wsConn net.Conn, destination string, hc *halfCloser) error {
+	wsWriter, err := user.messageWriter(wsConn)
 	if err != nil {
 		return err
 	}
@@ -387,6 +649,12 @@ func (pro *Proxy) pipeTCPToWS(ctx context.Context, user *User, tcpConn net.Conn,
 		n, err := tcpConn.Read(pack)
 		if err != nil {
 			if errors.Is(err, io.EOF) {
+				if hc.enabled {
+					if err := wsWriter.WriteMessage(ws.OpText, []byte(protocol.HalfCloseMessage)); err != nil {
+						return err
+					}
+				}
+				hc.finish()
 				return nil
 			}
 			if isTimeoutErr(err) {
@@ -395,23 +663,41 @@ func (pro *Proxy) pipeTCPToWS(ctx context.Context, user *User, tcpConn net.Conn,
 			return err
 		}
 
-		user.UsedTrafficBytes.Add(int64(n))
+		user.AddDownload(int64(n) + pro.serverFrameOverhead(n))
+		user.destinations.add(destination, 0, int64(n))
 
-		if err := wsutil.WriteServerBinary(wsWriter, pack[:n]); err != nil {
+		if err := wsWriter.WriteMessage(ws.OpBinary, pack[:n]); err != nil {
 			return err
 		}
 	}
 }
 
-func (pro *Proxy) findUser(ctx context.Context, uid int64, rateLimit int64) *User {
+func (pro *Proxy) findUser(ctx context.Context, result *AuthResult) *User {
 	pro.userMutex.Lock()
 	defer pro.userMutex.Unlock()
-	if user, exists := pro.Users[uid]; exists {
+	maxConns := result.MaxConns
+	if maxConns <= 0 {
+		maxConns = pro.MaximumConnectionsPerUser
+	}
+	burst := result.RateBurst
+	if burst <= 0 {
+		burst = pro.RateLimitBurst
+	}
+	upload, download := result.RateLimits()
+	user, exists := pro.Users[result.UserID]
+	if exists {
 		pro.reportUser(ctx, user, false)
-		return user
+		user.SetMaxConns(maxConns)
+	} else {
+		user = NewUser(result.UserID, 0, maxConns, 0)
+		user.metrics = &pro.metrics
+		pro.Users[result.UserID] = user
+	}
+	user.setAuthRateLimit(upload, download, burst)
+	user.applyAuthResult(result, pro.unackedBytes(user.ID))
+	if pro.DestinationUsageSink != nil {
+		user.enableDestinationStats(max(pro.DestinationUsageTopN, 1))
 	}
-	user := NewUser(uid, 0, pro.MaximumConnectionsPerUser, rateLimit)
-	pro.Users[uid] = user
 	return user
 }
 
@@ -428,11 +714,11 @@ func (pro *Proxy) cleanupUser(ctx context.Context, uid int64, forceReport bool)
 	}
 }
 
+// reportUser reports the user's usage in the background once enough piled up,
+// or right away when force is set. Callers must hold userMutex.
 func (pro *Proxy) reportUser(ctx context.Context, user *User, force bool) bool {
-	usedTraffic := user.UsedTrafficBytes.Load()
-	reportedTraffic := user.ReportedTrafficBytes.Load()
-	trafficResult := usedTraffic - reportedTraffic
 	now := nowns()
+	trafficResult := user.pendingUsage(now).TotalBytes()
 	if !force {
 		if trafficResult == 0 {
 			return false
@@ -441,12 +727,44 @@ func (pro *Proxy) reportUser(ctx context.Context, user *User, force bool) bool {
 			return false
 		}
 	}
+	if !pro.acquireReport() {
+		// Shutdown is past waiting for reports; its flush picks the usage up.
+		pro.unreportedUsers[user] = struct{}{}
+		return false
+	}
+	record := user.takeUsage(now)
+	if record.TotalBytes() == 0 {
+		pro.reportWG.Done()
+		return true
+	}
+	// The record counts as in flight until it's journaled or reported.
+	pro.addInFlight(user.ID, record.TotalBytes())
 	go func() {
-		err := pro.Auth.ReportUsage(ctx, user.ID, trafficResult)
-		if err == nil {
-			user.ReportedTrafficBytes.Store(usedTraffic)
-			user.LastTrafficUpdateTick.Store(now)
+		defer pro.reportWG.Done()
+		// The request that triggered the report may be gone by now.
+		ctx := context.WithoutCancel(ctx)
+		if pro.journal != nil {
+			// Appending syncs the journal to disk, so it stays out of userMutex.
+			err := pro.journal.Append(record)
+			if err != nil {
+				slog.Error("Failed to journal usage: "+err.Error(), slog.Int64("user-id", user.ID))
+				user.restoreUsage(record)
+				pro.keepUnreported(user)
+			}
+			pro.addInFlight(user.ID, -record.TotalBytes())
+			if err == nil {
+				pro.reportDestinationUsage(ctx, user, record)
+			}
+			return
+		}
+		err := pro.reportUsage(ctx, record)
+		if err != nil {
+			slog.Debug("Failed to report usage: "+err.Error(), slog.Int64("user-id", user.ID))
+			user.restoreUsage(record)
+			pro.keepUnreported(user)
 		}
+		pro.addInFlight(user.ID, -record.TotalBytes())
+		pro.reportDestinationUsage(ctx, user, record)
 	}()
 	return true
 }
@@ -460,6 +778,7 @@ func (pro *Proxy) cleanupUserConn(ctx context.Context, user *User, conn net.Conn
 		if !sent {
 			pro.reportUser(ctx, user, true)
 		}
+		user.stopExpiryTimer()
 		delete(pro.Users, user.ID)
 	}
 	return err
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by every connection of a user. Callers
+// reserve tokens in small chunks and sleep off their own debt, so concurrent
+// connections are served in reservation order and split the rate evenly.
+type rateLimiter struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(rate int64, burst int64) *rateLimiter {
+	limiter := &rateLimiter{last: time.Now()}
+	limiter.SetRate(rate, burst)
+	limiter.tokens = limiter.burst
+	return limiter
+}
+
+// SetRate changes the rate in bytes per second. Zero disables limiting and a
+// zero burst defaults to one second worth of traffic.
+func (limiter *rateLimiter) SetRate(rate int64, burst int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	limiter.refill(time.Now())
+	limiter.rate = float64(rate)
+	if burst <= 0 {
+		burst = rate
+	}
+	limiter.burst = float64(burst)
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+}
+
+func (limiter *rateLimiter) Rate() (rate int64, burst int64) {
+	limiter.mutex.Lock()
+	defer limiter.mutex.Unlock()
+	return int64(limiter.rate), int64(limiter.burst)
+}
+
+func (limiter *rateLimiter) Wait(n int) {
+	if n <= 0 {
+		return
+	}
+
+	limiter.mutex.Lock()
+	if limiter.rate <= 0 {
+		limiter.mutex.Unlock()
+		return
+	}
+	now := time.Now()
+	limiter.refill(now)
+	limiter.tokens -= float64(n)
+	var delay time.Duration
+	if limiter.tokens < 0 {
+		delay = time.Duration(-limiter.tokens / limiter.rate * float64(time.Second))
+	}
+	limiter.mutex.Unlock()
+
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
+
+func (limiter *rateLimiter) refill(now time.Time) {
+	elapsed := now.Sub(limiter.last).Seconds()
+	limiter.last = now
+	if limiter.rate <= 0 {
+		limiter.tokens = limiter.burst
+		return
+	}
+	limiter.tokens += elapsed * limiter.rate
+	if limiter.tokens > limiter.burst {
+		limiter.tokens = limiter.burst
+	}
+}
+
+type limitedReader struct {
+	reader  io.Reader
+	limiter *rateLimiter
+	count   *atomic.Int64
+}
+
+func (reader *limitedReader) Read(p []byte) (int, error) {
+	n, err := reader.reader.Read(p)
+	reader.limiter.Wait(n)
+	if reader.count != nil {
+		reader.count.Add(int64(n))
+	}
+	return n, err
+}
+
+type limitedWriter struct {
+	writer  io.Writer
+	limiter *rateLimiter
+	count   *atomic.Int64
+}
+
+func (writer *limitedWriter) Write(p []byte) (int, error) {
+	writer.limiter.Wait(len(p))
+	return writer.writeReserved(p)
+}
+
+// writeReserved writes p whose tokens the caller already waited for.
+func (writer *limitedWriter) writeReserved(p []byte) (int, error) {
+	n, err := writer.writer.Write(p)
+	if writer.count != nil {
+		writer.count.Add(int64(n))
+	}
+	return n, err
+}
+
+// unthrottledWriter writes through a limitedWriter without waiting.
+type unthrottledWriter struct {
+	writer *limitedWriter
+}
+
+func (w unthrottledWriter) Write(p []byte) (int, error) {
+	return w.writer.writeReserved(p)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefill(t *testing.T) {
+	tests := []struct {
+		name    string
+		rate    int64
+		burst   int64
+		spend   float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"half a second", 1000, 0, 1000, 500 * time.Millisecond, 500},
+		{"capped at burst", 1000, 2000, 100, time.Hour, 2000},
+		{"pays off debt", 1000, 0, 3000, time.Second, -1000},
+		{"unlimited", 0, 0, 5000, 0, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := newRateLimiter(test.rate, test.burst)
+			limiter.tokens -= test.spend
+			limiter.refill(limiter.last.Add(test.elapsed))
+			if limiter.tokens != test.want {
+				t.Errorf("tokens = %v, want %v", limiter.tokens, test.want)
+			}
+		})
+	}
+}
+
+func TestRateLimiterSetRate(t *testing.T) {
+	limiter := newRateLimiter(1000, 4000)
+	if rate, burst := limiter.Rate(); rate != 1000 || burst != 4000 {
+		t.Errorf("Rate = %d, %d, want 1000, 4000", rate, burst)
+	}
+
+	limiter.SetRate(500, 0)
+	if rate, burst := limiter.Rate(); rate != 500 || burst != 500 {
+		t.Errorf("Rate = %d, %d, want the burst to default to the rate", rate, burst)
+	}
+	if limiter.tokens > 500 {
+		t.Errorf("tokens = %v, want them capped at the new burst", limiter.tokens)
+	}
+}
+
+func TestRateLimiterWait(t *testing.T) {
+	limiter := newRateLimiter(10000, 0)
+
+	start := time.Now()
+	limiter.Wait(10000)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("spending the burst took %v", elapsed)
+	}
+
+	start = time.Now()
+	limiter.Wait(2000)
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond || elapsed > time.Second {
+		t.Errorf("Wait(2000) at 10000 B/s over an empty bucket took %v, want about 200ms", elapsed)
+	}
+
+	limiter.SetRate(0, 0)
+	start = time.Now()
+	limiter.Wait(1 << 30)
+	if elapsed := time.Since(start); elapsed > 50*time.Millisecond {
+		t.Errorf("unlimited Wait took %v", elapsed)
+	}
+}
@@ -0,0 +1,190 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/itsabgr/ge"
+	"golang.org/x/sync/singleflight"
+)
+
+// Resolver looks up the addresses of a destination host. ttl says how long
+// the answer may be cached; zero means the resolver doesn't know.
+type Resolver interface {
+	LookupAddrs(ctx context.Context, host string) (addrs []netip.Addr, ttl time.Duration, err error)
+}
+
+var _ Resolver = &SystemResolver{}
+
+// SystemResolver uses the operating system's resolver, which doesn't expose
+// record TTLs.
+type SystemResolver struct {
+	Resolver *net.Resolver
+}
+
+func (resolver *SystemResolver) LookupAddrs(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	netResolver := resolver.Resolver
+	if netResolver == nil {
+		netResolver = net.DefaultResolver
+	}
+	addrs, err := netResolver.LookupNetIP(ctx, "ip", host)
+	return addrs, 0, err
+}
+
+var _ Resolver = &HostsResolver{}
+
+// HostsResolver answers from a static map and hands everything else to
+// Fallback, failing with a not-found error when there is none.
+type HostsResolver struct {
+	Hosts    map[string][]netip.Addr
+	Fallback Resolver
+}
+
+func (resolver *HostsResolver) LookupAddrs(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	if addrs, found := resolver.Hosts[normalizeHost(host)]; found {
+		return addrs, 0, nil
+	}
+	if resolver.Fallback != nil {
+		return resolver.Fallback.LookupAddrs(ctx, host)
+	}
+	return nil, 0, notFoundError(host)
+}
+
+var _ Resolver = &CachingResolver{}
+
+// CachingResolver caches the answers of Upstream for their TTL, caches
+// not-found answers for NegativeTTL and merges concurrent lookups of the same
+// host into one upstream query. Temporary failures are never cached.
+type CachingResolver struct {
+	Upstream    Resolver
+	DefaultTTL  time.Duration
+	MaxTTL      time.Duration
+	NegativeTTL time.Duration
+	MaxEntries  int
+
+	mutex   sync.Mutex
+	entries map[string]resolverEntry
+	group   singleflight.Group
+}
+
+type resolverEntry struct {
+	addrs   []netip.Addr
+	err     error
+	expires time.Time
+}
+
+type resolverAnswer struct {
+	addrs []netip.Addr
+	ttl   time.Duration
+}
+
+func NewCachingResolver(upstream Resolver) *CachingResolver {
+	return &CachingResolver{
+		Upstream:    upstream,
+		DefaultTTL:  time.Minute,
+		MaxTTL:      time.Hour,
+		NegativeTTL: time.Second * 30,
+		MaxEntries:  10000,
+		entries:     map[string]resolverEntry{},
+	}
+}
+
+func (resolver *CachingResolver) LookupAddrs(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	host = normalizeHost(host)
+	now := time.Now()
+
+	resolver.mutex.Lock()
+	entry, found := resolver.entries[host]
+	resolver.mutex.Unlock()
+	if found && now.Before(entry.expires) {
+		return entry.addrs, entry.expires.Sub(now), entry.err
+	}
+
+	// The shared lookup outlives any single caller, so it must not inherit
+	// one caller's cancellation.
+	result := resolver.group.DoChan(host, func() (any, error) {
+		addrs, ttl, err := resolver.Upstream.LookupAddrs(context.WithoutCancel(ctx), host)
+		ttl = resolver.store(host, addrs, ttl, err)
+		return resolverAnswer{addrs: addrs, ttl: ttl}, err
+	})
+
+	select {
+	case <-ctx.Done():
+		return nil, 0, ctx.Err()
+	case res := <-result:
+		answer, _ := res.Val.(resolverAnswer)
+		return answer.addrs, answer.ttl, res.Err
+	}
+}
+
+// Flush drops every cached answer.
+func (resolver *CachingResolver) Flush() {
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	resolver.entries = map[string]resolverEntry{}
+}
+
+func (resolver *CachingResolver) store(host string, addrs []netip.Addr, ttl time.Duration, err error) time.Duration {
+	if err != nil {
+		if dnsErr, ok := ge.As[*net.DNSError](err); !ok || !dnsErr.IsNotFound {
+			return 0
+		}
+		if ttl <= 0 || ttl > resolver.NegativeTTL {
+			ttl = resolver.NegativeTTL
+		}
+		addrs = nil
+	} else {
+		if ttl <= 0 {
+			ttl = resolver.DefaultTTL
+		}
+		if resolver.MaxTTL > 0 && ttl > resolver.MaxTTL {
+			ttl = resolver.MaxTTL
+		}
+	}
+	if ttl <= 0 {
+		return 0
+	}
+
+	now := time.Now()
+	resolver.mutex.Lock()
+	defer resolver.mutex.Unlock()
+	if resolver.entries == nil {
+		resolver.entries = map[string]resolverEntry{}
+	}
+	if resolver.MaxEntries > 0 && len(resolver.entries) >= resolver.MaxEntries {
+		for key, entry := range resolver.entries {
+			if !now.Before(entry.expires) {
+				delete(resolver.entries, key)
+			}
+		}
+		for key := range resolver.entries {
+			if len(resolver.entries) < resolver.MaxEntries {
+				break
+			}
+			delete(resolver.entries, key)
+		}
+	}
+	resolver.entries[host] = resolverEntry{addrs: addrs, err: err, expires: now.Add(ttl)}
+	return ttl
+}
+
+var defaultResolver = &SystemResolver{}
+
+func (pro *Proxy) resolver() Resolver {
+	if pro.Resolver == nil {
+		return defaultResolver
+	}
+	return pro.Resolver
+}
+
+func normalizeHost(host string) string {
+	return strings.TrimSuffix(strings.ToLower(host), ".")
+}
+
+func notFoundError(host string) error {
+	return &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
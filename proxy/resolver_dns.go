@@ -0,0 +1,248 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"net/netip"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+	"golang.org/x/sync/errgroup"
+)
+
+const dnsUDPSize = 1232
+
+var _ Resolver = &DNSResolver{}
+
+// DNSResolver queries a DNS server directly so record TTLs are known. Server
+// is a host:port, Network is "udp" (the default, retrying over TCP when the
+// answer is truncated) or "tcp".
+type DNSResolver struct {
+	Server  string
+	Network string
+	Timeout time.Duration
+	Dialer  *net.Dialer
+}
+
+// LookupAddrs queries A and AAAA records in parallel. The returned TTL is the
+// smallest one among the answers, or the SOA minimum for a not-found answer.
+func (resolver *DNSResolver) LookupAddrs(ctx context.Context, host string) ([]netip.Addr, time.Duration, error) {
+	name, err := dnsmessage.NewName(normalizeHost(host) + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	timeout := resolver.Timeout
+	if timeout <= 0 {
+		timeout = time.Second * 5
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	var answers [2]dnsAnswer
+	eg := errgroup.Group{}
+	for i, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		eg.Go(func() error {
+			answer, err := resolver.query(ctx, name, qtype)
+			answers[i] = answer
+			return err
+		})
+	}
+	if err := eg.Wait(); err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: host, Server: resolver.Server, IsTemporary: true, IsTimeout: isTimeoutErr(err)}
+	}
+
+	var addrs []netip.Addr
+	var ttl time.Duration
+	for _, answer := range answers {
+		addrs = append(addrs, answer.addrs...)
+		if answer.ttl > 0 && (ttl == 0 || answer.ttl < ttl) {
+			ttl = answer.ttl
+		}
+	}
+	if len(addrs) == 0 {
+		return nil, ttl, &net.DNSError{Err: "no such host", Name: host, Server: resolver.Server, IsNotFound: true}
+	}
+	return addrs, ttl, nil
+}
+
+type dnsAnswer struct {
+	addrs []netip.Addr
+	ttl   time.Duration
+}
+
+func (resolver *DNSResolver) query(ctx context.Context, name dnsmessage.Name, qtype dnsmessage.Type) (dnsAnswer, error) {
+	id := uint16(rand.Uint32())
+	builder := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: id, RecursionDesired: true})
+	builder.EnableCompression()
+	if err := builder.StartQuestions(); err != nil {
+		return dnsAnswer{}, err
+	}
+	if err := builder.Question(dnsmessage.Question{Name: name, Type: qtype, Class: dnsmessage.ClassINET}); err != nil {
+		return dnsAnswer{}, err
+	}
+	if err := builder.StartAdditionals(); err != nil {
+		return dnsAnswer{}, err
+	}
+	var opt dnsmessage.ResourceHeader
+	if err := opt.SetEDNS0(dnsUDPSize, dnsmessage.RCodeSuccess, false); err != nil {
+		return dnsAnswer{}, err
+	}
+	if err := builder.OPTResource(opt, dnsmessage.OPTResource{}); err != nil {
+		return dnsAnswer{}, err
+	}
+	request, err := builder.Finish()
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+
+	network := resolver.Network
+	if network == "" {
+		network = "udp"
+	}
+	response, err := resolver.exchange(ctx, network, request)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+
+	var parser dnsmessage.Parser
+	header, err := parser.Start(response)
+	if err != nil {
+		return dnsAnswer{}, err
+	}
+	if header.ID != id || !header.Response {
+		return dnsAnswer{}, errors.New("mismatched dns response")
+	}
+	if header.Truncated && network == "udp" {
+		if response, err = resolver.exchange(ctx, "tcp", request); err != nil {
+			return dnsAnswer{}, err
+		}
+		if header, err = parser.Start(response); err != nil {
+			return dnsAnswer{}, err
+		}
+	}
+	switch header.RCode {
+	case dnsmessage.RCodeSuccess, dnsmessage.RCodeNameError:
+	default:
+		return dnsAnswer{}, errors.New("dns server returned " + header.RCode.String())
+	}
+	if err := parser.SkipAllQuestions(); err != nil {
+		return dnsAnswer{}, err
+	}
+
+	answer := dnsAnswer{}
+	for {
+		rh, err := parser.AnswerHeader()
+		if errors.Is(err, dnsmessage.ErrSectionDone) {
+			break
+		}
+		if err != nil {
+			return dnsAnswer{}, err
+		}
+		var addr netip.Addr
+		switch {
+		case rh.Type == dnsmessage.TypeA && qtype == dnsmessage.TypeA:
+			r, err := parser.AResource()
+			if err != nil {
+				return dnsAnswer{}, err
+			}
+			addr = netip.AddrFrom4(r.A)
+		case rh.Type == dnsmessage.TypeAAAA && qtype == dnsmessage.TypeAAAA:
+			r, err := parser.AAAAResource()
+			if err != nil {
+				return dnsAnswer{}, err
+			}
+			addr = netip.AddrFrom16(r.AAAA)
+		default:
+			// CNAMEs are followed by the server; their TTL still bounds ours.
+			if err := parser.SkipAnswer(); err != nil {
+				return dnsAnswer{}, err
+			}
+		}
+		answer.ttl = minTTL(answer.ttl, time.Duration(rh.TTL)*time.Second)
+		if addr.IsValid() {
+			answer.addrs = append(answer.addrs, addr)
+		}
+	}
+
+	if len(answer.addrs) == 0 {
+		answer.ttl = 0
+		if err := parser.SkipAllAnswers(); err != nil {
+			return dnsAnswer{}, err
+		}
+		for {
+			rh, err := parser.AuthorityHeader()
+			if err != nil {
+				break
+			}
+			if rh.Type != dnsmessage.TypeSOA {
+				if err := parser.SkipAuthority(); err != nil {
+					break
+				}
+				continue
+			}
+			soa, err := parser.SOAResource()
+			if err != nil {
+				break
+			}
+			answer.ttl = minTTL(time.Duration(rh.TTL)*time.Second, time.Duration(soa.MinTTL)*time.Second)
+			break
+		}
+	}
+	return answer, nil
+}
+
+func (resolver *DNSResolver) exchange(ctx context.Context, network string, request []byte) ([]byte, error) {
+	dialer := resolver.Dialer
+	if dialer == nil {
+		dialer = &net.Dialer{}
+	}
+	server := resolver.Server
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "53")
+	}
+	conn, err := dialer.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if network == "udp" {
+		if _, err := conn.Write(request); err != nil {
+			return nil, err
+		}
+		response := make([]byte, dnsUDPSize)
+		n, err := conn.Read(response)
+		if err != nil {
+			return nil, err
+		}
+		return response[:n], nil
+	}
+
+	if _, err := conn.Write(append(binary.BigEndian.AppendUint16(nil, uint16(len(request))), request...)); err != nil {
+		return nil, err
+	}
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, response); err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+func minTTL(a time.Duration, b time.Duration) time.Duration {
+	if a <= 0 {
+		return b
+	}
+	return min(a, b)
+}
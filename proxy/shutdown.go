@@ -0,0 +1,137 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+func (pro *Proxy) acquireHandler() bool {
+	pro.lifecycleMutex.Lock()
+	defer pro.lifecycleMutex.Unlock()
+	if pro.closing {
+		return false
+	}
+	pro.handlerWG.Add(1)
+	return true
+}
+
+func (pro *Proxy) isClosing() bool {
+	pro.lifecycleMutex.Lock()
+	defer pro.lifecycleMutex.Unlock()
+	return pro.closing
+}
+
+// acquireReport registers a background report with reportWG, unless Shutdown
+// already waits for them: a WaitGroup must not grow while Wait may run.
+func (pro *Proxy) acquireReport() bool {
+	pro.lifecycleMutex.Lock()
+	defer pro.lifecycleMutex.Unlock()
+	if pro.reportsClosed {
+		return false
+	}
+	pro.reportWG.Add(1)
+	return true
+}
+
+// keepUnreported remembers a user whose report failed after it was dropped
+// from Users, so Shutdown can still flush its bytes.
+func (pro *Proxy) keepUnreported(user *User) {
+	pro.userMutex.Lock()
+	defer pro.userMutex.Unlock()
+	if pro.Users[user.ID] != user {
+		pro.unreportedUsers[user] = struct{}{}
+	}
+}
+
+// Shutdown stops accepting new upgrades, closes every live WebSocket with a
+// server shutdown close frame, waits for the pipes to finish until ctx is
+// done and finally reports all unreported usage synchronously.
+func (pro *Proxy) Shutdown(ctx context.Context) error {
+	pro.lifecycleMutex.Lock()
+	pro.closing = true
+	pro.lifecycleMutex.Unlock()
+
+	pro.userMutex.Lock()
+	for _, user := range pro.Users {
+		user.Terminate(ws.StatusCode(protocol.CloseServerShutdown), "server shutdown")
+	}
+	pro.userMutex.Unlock()
+
+	waitErr := waitContext(ctx, &pro.handlerWG)
+	if waitErr != nil {
+		pro.userMutex.Lock()
+		for _, user := range pro.Users {
+			user.Cleanup()
+		}
+		pro.userMutex.Unlock()
+	}
+	// Handlers still running after a timeout leave their usage to the flush.
+	pro.lifecycleMutex.Lock()
+	pro.reportsClosed = true
+	pro.lifecycleMutex.Unlock()
+	if err := waitContext(ctx, &pro.reportWG); err != nil && waitErr == nil {
+		waitErr = err
+	}
+
+	flushErr := pro.flushUsage(context.WithoutCancel(ctx))
+	if pro.journal != nil {
+		flushErr = errors.Join(flushErr, pro.closeJournal(ctx))
+	}
+	return errors.Join(waitErr, flushErr)
+}
+
+func (pro *Proxy) flushUsage(ctx context.Context) error {
+	pro.userMutex.Lock()
+	users := make([]*User, 0, len(pro.Users)+len(pro.unreportedUsers))
+	for _, user := range pro.Users {
+		users = append(users, user)
+	}
+	for user := range pro.unreportedUsers {
+		users = append(users, user)
+	}
+	pro.unreportedUsers = map[*User]struct{}{}
+	pro.userMutex.Unlock()
+
+	var errs []error
+	for _, user := range users {
+		if user.pendingUsage(nowns()).TotalBytes() <= 0 {
+			continue
+		}
+		record := user.takeUsage(nowns())
+		if pro.journal != nil {
+			if err := pro.journal.Append(record); err != nil {
+				slog.Error("Failed to journal usage: "+err.Error(), slog.Int64("user-id", user.ID), slog.Int64("traffic", record.TotalBytes()))
+				user.restoreUsage(record)
+				errs = append(errs, err)
+			}
+			pro.reportDestinationUsage(ctx, user, record)
+			continue
+		}
+		if err := pro.reportUsage(ctx, record); err != nil {
+			slog.Error("Failed to flush usage: "+err.Error(), slog.Int64("user-id", user.ID), slog.Int64("traffic", record.TotalBytes()))
+			user.restoreUsage(record)
+			errs = append(errs, err)
+		}
+		pro.reportDestinationUsage(ctx, user, record)
+	}
+	return errors.Join(errs...)
+}
+
+func waitContext(ctx context.Context, wg *sync.WaitGroup) error {
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
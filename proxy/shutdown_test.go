@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+func TestPipeConnAfterShutdown(t *testing.T) {
+	pro := NewProxy(nil, 4, time.Hour, 1<<20)
+	pro.closing = true
+	user := NewUser(1, 0, 4, 0)
+	pro.Users[user.ID] = user
+
+	serverConn, clientConn := net.Pipe()
+	defer clientConn.Close()
+	errc := make(chan error, 1)
+	go func() {
+		errc <- pro.pipeConn(context.Background(), user, nil, serverConn, "tcp", nil, handshake{})
+	}()
+
+	clientConn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	frame, err := ws.ReadFrame(clientConn)
+	if err != nil {
+		t.Fatalf("ReadFrame: %v", err)
+	}
+	if frame.Header.OpCode != ws.OpClose {
+		t.Fatalf("got a %v frame, want a close frame", frame.Header.OpCode)
+	}
+	if code, _ := ws.ParseCloseFrameData(frame.Payload); code != ws.StatusCode(protocol.CloseServerShutdown) {
+		t.Errorf("close code = %d, want %d", code, protocol.CloseServerShutdown)
+	}
+	if err := <-errc; err == nil {
+		t.Error("pipeConn accepted a conn during shutdown")
+	}
+}
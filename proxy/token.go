@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/b00tkitism/wsc/protocol"
+)
+
+// requestToken looks for the auth token in the Authorization header, the
+// Sec-WebSocket-Protocol header, the auth cookie and finally the query string,
+// returning the token and where it was found.
+func (pro *Proxy) requestToken(request *http.Request) (string, string) {
+	if token, ok := strings.CutPrefix(request.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return strings.TrimSpace(token), "header"
+	}
+
+	for _, value := range request.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			if token, err := protocol.ParseAuthSubprotocol(strings.TrimSpace(p)); err == nil && token != "" {
+				return token, "subprotocol"
+			}
+		}
+	}
+
+	if cookie, err := request.Cookie(protocol.AuthCookieName); err == nil && cookie.Value != "" {
+		return cookie.Value, "cookie"
+	}
+
+	if token := request.URL.Query().Get(protocol.AuthQueryParam); token != "" {
+		if pro.DisableQueryAuth {
+			return "", "query"
+		}
+		return token, "query"
+	}
+
+	return "", ""
+}
+
+// redactToken keeps just enough of a token to correlate log lines.
+func redactToken(token string) string {
+	if len(token) <= 8 {
+		return "***(" + strconv.Itoa(len(token)) + ")"
+	}
+	return token[:4] + "***(" + strconv.Itoa(len(token)) + ")"
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/b00tkitism/wsc/protocol"
+)
+
+// maxUDPPayload is the largest datagram UDP can carry and maxUDPMessageSize
+// the largest WebSocket message it takes to tunnel one.
+const (
+	maxUDPPayload     = 65535
+	maxUDPMessageSize = maxUDPPayload + protocol.PacketFrameMaxHeaderLen
+)
+
+// UDPFiltering decides which remote hosts may send packets back through a
+// UDP session, in the terms of RFC 4787.
+type UDPFiltering int
+
+const (
+	// UDPAddressRestricted accepts packets from any port of a host the client
+	// sent to recently.
+	UDPAddressRestricted UDPFiltering = iota
+	// UDPPortRestricted only accepts packets from the exact address and port
+	// the client sent to.
+	UDPPortRestricted
+	// UDPFullCone accepts packets from anyone once the client sent a packet.
+	UDPFullCone
+)
+
+// udpSession is the NAT table of one net=udp WebSocket. Every destination the
+// client sends to gets a mapping that expires after the idle timeout.
+// Version 2 sessions speak protocol.PacketFrame instead of the legacy
+// protocol.PacketConnPayload, with domain targets only when negotiated.
+type udpSession struct {
+	framed          bool
+	domains         bool
+	filtering       UDPFiltering
+	pinned          []netip.AddrPort
+	maxDestinations int
+	idleTimeout     time.Duration
+
+	mutex        sync.Mutex
+	mappings     map[netip.AddrPort]udpMapping
+	lastActivity int64
+	lastSweep    int64
+}
+
+// udpMapping remembers when the client last sent to a destination and the
+// domain it used, so replies can name the same domain.
+type udpMapping struct {
+	lastSeen int64
+	domain   string
+}
+
+func (pro *Proxy) newUDPSession(target *endpointAddr, hs handshake) *udpSession {
+	session := &udpSession{
+		framed:          hs.version >= protocol.Version2,
+		domains:         hs.capabilities.Has(protocol.CapUDPDomain),
+		filtering:       pro.UDPFiltering,
+		maxDestinations: pro.UDPMaxDestinations,
+		idleTimeout:     pro.UDPIdleTimeout,
+		mappings:        map[netip.AddrPort]udpMapping{},
+		lastActivity:    nowns(),
+	}
+	if pro.UDPPinEndpoint {
+		session.pinned = target.addrPorts()
+		for i, addrPort := range session.pinned {
+			session.pinned[i] = unmapAddrPort(addrPort)
+		}
+	}
+	return session
+}
+
+// allowOutbound records a packet from the client to dst, refusing
+// destinations outside the pinned endpoint and new ones beyond the cap.
+// domain is the name the client used for dst, if any.
+func (session *udpSession) allowOutbound(dst netip.AddrPort, domain string) error {
+	dst = unmapAddrPort(dst)
+	if session.pinned != nil && !slices.Contains(session.pinned, dst) {
+		return errors.New("destination " + dst.String() + " isn't the session endpoint")
+	}
+
+	now := nowns()
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.sweep(now)
+	if _, found := session.mappings[dst]; !found && session.maxDestinations > 0 && len(session.mappings) >= session.maxDestinations {
+		return errors.New("session reached " + strconv.Itoa(session.maxDestinations) + " destinations")
+	}
+	session.mappings[dst] = udpMapping{lastSeen: now, domain: domain}
+	session.lastActivity = now
+	return nil
+}
+
+// allowInbound reports whether a packet from src may reach the client and
+// the domain the client knows src by.
+func (session *udpSession) allowInbound(src netip.AddrPort) (string, bool) {
+	src = unmapAddrPort(src)
+
+	now := nowns()
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	session.sweep(now)
+
+	mapping, found := session.mappings[src]
+	allowed := found
+	switch session.filtering {
+	case UDPFullCone:
+		allowed = len(session.mappings) > 0
+	case UDPPortRestricted:
+	default:
+		for dst := range session.mappings {
+			if dst.Addr() == src.Addr() {
+				allowed = true
+				break
+			}
+		}
+	}
+	if allowed {
+		session.lastActivity = now
+	}
+	return mapping.domain, allowed
+}
+
+// idle reports whether nothing passed through the session for the idle
+// timeout.
+func (session *udpSession) idle() bool {
+	if session.idleTimeout <= 0 {
+		return false
+	}
+	session.mutex.Lock()
+	defer session.mutex.Unlock()
+	return time.Duration(nowns()-session.lastActivity) >= session.idleTimeout
+}
+
+// sweep drops mappings that saw no outbound packet for the idle timeout, at
+// most once a second. Callers must hold the mutex.
+func (session *udpSession) sweep(now int64) {
+	if session.idleTimeout <= 0 || time.Duration(now-session.lastSweep) < time.Second {
+		return
+	}
+	session.lastSweep = now
+	for dst, mapping := range session.mappings {
+		if time.Duration(now-mapping.lastSeen) >= session.idleTimeout {
+			delete(session.mappings, dst)
+		}
+	}
+}
+
+func (session *udpSession) decodePacket(data []byte) (protocol.PacketFrame, error) {
+	if session.framed {
+		frame := protocol.PacketFrame{}
+		return frame, frame.UnmarshalBinaryUnsafe(data)
+	}
+	payload := protocol.PacketConnPayload{}
+	if err := payload.UnmarshalBinaryUnsafe(data); err != nil {
+		return protocol.PacketFrame{}, err
+	}
+	return protocol.PacketFrame{Addr: payload.AddrPort.Addr(), Port: payload.AddrPort.Port(), Payload: payload.Payload}, nil
+}
+
+// encodePacket frames a datagram from src for the client, naming src by
+// domain when the client sent to it by name.
+func (session *udpSession) encodePacket(src netip.AddrPort, domain string, data []byte) ([]byte, error) {
+	if !session.framed {
+		payload := protocol.PacketConnPayload{AddrPort: src, Payload: data}
+		return payload.MarshalBinary()
+	}
+	frame := protocol.PacketFrame{Addr: src.Addr(), Domain: domain, Port: src.Port(), Payload: data}
+	return frame.MarshalBinary()
+}
+
+// packetTarget returns the address a datagram goes to, resolving domain
+// targets and applying the destination policy.
+func (pro *Proxy) packetTarget(ctx context.Context, user *User, session *udpSession, frame protocol.PacketFrame) (netip.AddrPort, error) {
+	if frame.Domain != "" && !session.domains {
+		return netip.AddrPort{}, errors.New("domain targets weren't negotiated")
+	}
+	if frame.Domain == "" {
+		dst := netip.AddrPortFrom(frame.Addr, frame.Port)
+		return dst, pro.checkDestination(user, "", dst)
+	}
+	addr, err := parseEndpointAddr(ctx, pro.resolver(), frame.Host(), pro.familyPreference(user), pro.destinationChecker(user))
+	if err != nil {
+		return netip.AddrPort{}, err
+	}
+	return addr.addrPort(), nil
+}
+
+func unmapAddrPort(addrPort netip.AddrPort) netip.AddrPort {
+	return netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+}
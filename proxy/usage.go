@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"time"
+
+	"github.com/gobwas/ws"
+)
+
+// UsageRecord is the traffic of one user between two reports. Upload is what
+// the client sent towards destinations, Download what it received.
+//
+// ID is only set on records that went through a UsageJournal; it stays the
+// same when a record is delivered again after a crash, so the authenticator
+// can drop duplicates.
+type UsageRecord struct {
+	ID            string
+	UserID        int64
+	UploadBytes   int64
+	DownloadBytes int64
+	Start         time.Time
+	End           time.Time
+}
+
+func (record UsageRecord) TotalBytes() int64 {
+	return record.UploadBytes + record.DownloadBytes
+}
+
+// pendingUsage returns the traffic the user made since its last successful
+// report.
+func (user *User) pendingUsage(now int64) UsageRecord {
+	start := user.LastTrafficUpdateTick.Load()
+	if start == 0 {
+		start = user.createdAt
+	}
+	return UsageRecord{
+		UserID:        user.ID,
+		UploadBytes:   user.UploadBytes.Load() - user.ReportedUploadBytes.Load(),
+		DownloadBytes: user.DownloadBytes.Load() - user.ReportedDownloadBytes.Load(),
+		Start:         time.Unix(0, start),
+		End:           time.Unix(0, now),
+	}
+}
+
+// takeUsage returns the traffic made since the last report and marks it as
+// reported right away, so overlapping reports never carry the same bytes.
+func (user *User) takeUsage(now int64) UsageRecord {
+	user.reportMutex.Lock()
+	defer user.reportMutex.Unlock()
+	record := user.pendingUsage(now)
+	user.ReportedUploadBytes.Add(record.UploadBytes)
+	user.ReportedDownloadBytes.Add(record.DownloadBytes)
+	user.ReportedTrafficBytes.Add(record.TotalBytes())
+	user.LastTrafficUpdateTick.Store(now)
+	return record
+}
+
+// restoreUsage hands back a record whose report failed so the next report
+// includes it again.
+func (user *User) restoreUsage(record UsageRecord) {
+	user.reportMutex.Lock()
+	defer user.reportMutex.Unlock()
+	user.ReportedUploadBytes.Add(-record.UploadBytes)
+	user.ReportedDownloadBytes.Add(-record.DownloadBytes)
+	user.ReportedTrafficBytes.Add(-record.TotalBytes())
+	if user.LastTrafficUpdateTick.Load() == record.End.UnixNano() {
+		user.LastTrafficUpdateTick.Store(record.Start.UnixNano())
+	}
+}
+
+// addInFlight tracks usage of uid handed to the authenticator outside the
+// journal while its report is running.
+func (pro *Proxy) addInFlight(uid int64, n int64) {
+	pro.inFlightMutex.Lock()
+	defer pro.inFlightMutex.Unlock()
+	if pro.inFlight == nil {
+		pro.inFlight = map[int64]int64{}
+	}
+	if pro.inFlight[uid] += n; pro.inFlight[uid] == 0 {
+		delete(pro.inFlight, uid)
+	}
+}
+
+// unackedBytes is the usage of uid the authenticator hasn't confirmed outside
+// the live User, so the RemainingBytes it answers with doesn't cover it yet:
+// reports in flight, journaled records and users whose report failed after
+// they were dropped. Callers must hold userMutex.
+func (pro *Proxy) unackedBytes(uid int64) int64 {
+	pro.inFlightMutex.Lock()
+	n := pro.inFlight[uid]
+	pro.inFlightMutex.Unlock()
+	if pro.journal != nil {
+		n += pro.journal.pendingBytes(uid)
+	}
+	for user := range pro.unreportedUsers {
+		if user.ID == uid {
+			n += user.pendingUsage(nowns()).TotalBytes()
+		}
+	}
+	return n
+}
+
+// clientFrameOverhead is what a client frame costs on the wire beyond its
+// payload, or zero unless Proxy.CountFrameOverhead is set.
+func (pro *Proxy) clientFrameOverhead(header ws.Header) int64 {
+	if !pro.CountFrameOverhead {
+		return 0
+	}
+	return int64(ws.HeaderSize(header))
+}
+
+// serverFrameOverhead is the header size of an unmasked frame carrying n
+// bytes, or zero unless Proxy.CountFrameOverhead is set.
+func (pro *Proxy) serverFrameOverhead(n int) int64 {
+	if !pro.CountFrameOverhead {
+		return 0
+	}
+	return int64(ws.HeaderSize(ws.Header{Length: int64(n)}))
+}
+
+// frameOverhead passes through bytes of wsc framing when
+// Proxy.CountFrameOverhead is set.
+func (pro *Proxy) frameOverhead(n int64) int64 {
+	if !pro.CountFrameOverhead {
+		return 0
+	}
+	return n
+}
@@ -0,0 +1,387 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	journalCompactAcks = 256
+	journalMinBackoff  = time.Second
+	journalMaxBackoff  = time.Minute
+)
+
+type journalEntry struct {
+	Op     string       `json:"op"`
+	Seq    uint64       `json:"seq"`
+	Record *UsageRecord `json:"record,omitempty"`
+}
+
+// UsageJournal is an append-only file of usage records that haven't been
+// accepted by the authenticator yet. Records are synced to disk before they're
+// handed to the authenticator, replayed until ReportUsage succeeds and dropped
+// from the file by compaction once acknowledged.
+type UsageJournal struct {
+	path string
+
+	mutex   sync.Mutex
+	file    *os.File
+	size    int64
+	broken  error
+	nextSeq uint64
+	pending map[uint64]UsageRecord
+	acked   int
+	wake    chan struct{}
+}
+
+// OpenUsageJournal opens or creates the journal at path and loads the records
+// left undelivered by a previous run.
+func OpenUsageJournal(path string) (*UsageJournal, error) {
+	journal := &UsageJournal{
+		path:    path,
+		nextSeq: 1,
+		pending: map[uint64]UsageRecord{},
+		wake:    make(chan struct{}, 1),
+	}
+
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	valid, err := journal.replay(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	// Drop a record torn by a crash in the middle of a write.
+	if err := file.Truncate(valid); err != nil {
+		file.Close()
+		return nil, err
+	}
+	if _, err := file.Seek(valid, io.SeekStart); err != nil {
+		file.Close()
+		return nil, err
+	}
+	journal.file = file
+
+	if err := journal.compact(); err != nil {
+		journal.file.Close()
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (journal *UsageJournal) replay(file *os.File) (int64, error) {
+	reader := bufio.NewReader(file)
+	var valid int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return valid, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+
+		entry := journalEntry{}
+		if err := json.Unmarshal(bytes.TrimSpace(line), &entry); err != nil {
+			return valid, nil
+		}
+		switch entry.Op {
+		case "add":
+			if entry.Record != nil {
+				journal.pending[entry.Seq] = *entry.Record
+			}
+		case "ack":
+			delete(journal.pending, entry.Seq)
+		}
+		journal.nextSeq = max(journal.nextSeq, entry.Seq+1)
+		valid += int64(len(line))
+	}
+}
+
+// Append durably stores record. The record gets an ID when it has none so the
+// authenticator can recognize it if it's delivered again after a crash.
+func (journal *UsageJournal) Append(record UsageRecord) error {
+	if record.ID == "" {
+		id := make([]byte, 16)
+		rand.Read(id)
+		record.ID = hex.EncodeToString(id)
+	}
+
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return errors.New("usage journal is closed")
+	}
+	seq := journal.nextSeq
+	if err := journal.write(journalEntry{Op: "add", Seq: seq, Record: &record}); err != nil {
+		return err
+	}
+	journal.nextSeq++
+	journal.pending[seq] = record
+
+	select {
+	case journal.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// Pending returns how many records wait for delivery.
+func (journal *UsageJournal) Pending() int {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	return len(journal.pending)
+}
+
+// pendingBytes sums the traffic of uid waiting for delivery.
+func (journal *UsageJournal) pendingBytes(uid int64) int64 {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	var n int64
+	for _, record := range journal.pending {
+		if record.UserID == uid {
+			n += record.TotalBytes()
+		}
+	}
+	return n
+}
+
+// Run delivers pending records in order until ctx is done, backing off
+// exponentially while report keeps failing.
+func (journal *UsageJournal) Run(ctx context.Context, report func(ctx context.Context, record UsageRecord) error) {
+	backoff := time.Duration(0)
+	for {
+		seq, record, found := journal.next()
+		if !found {
+			select {
+			case <-journal.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		if err := report(ctx, record); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			backoff = min(max(backoff*2, journalMinBackoff), journalMaxBackoff)
+			slog.Warn("Failed to report journaled usage: "+err.Error(), slog.Int64("user-id", record.UserID), slog.Duration("retry-in", backoff))
+			select {
+			case <-time.After(backoff):
+			case <-journal.wake:
+			case <-ctx.Done():
+				return
+			}
+			continue
+		}
+		backoff = 0
+
+		if err := journal.ack(seq); err != nil {
+			slog.Error("Failed to acknowledge journaled usage: "+err.Error(), slog.Int64("user-id", record.UserID))
+		}
+	}
+}
+
+// Close stops further appends. Undelivered records stay on disk for the next
+// OpenUsageJournal.
+func (journal *UsageJournal) Close() error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return nil
+	}
+	err := journal.file.Close()
+	journal.file = nil
+	return err
+}
+
+func (journal *UsageJournal) next() (uint64, UsageRecord, bool) {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if len(journal.pending) == 0 {
+		return 0, UsageRecord{}, false
+	}
+	seqs := make([]uint64, 0, len(journal.pending))
+	for seq := range journal.pending {
+		seqs = append(seqs, seq)
+	}
+	seq := slices.Min(seqs)
+	return seq, journal.pending[seq], true
+}
+
+func (journal *UsageJournal) ack(seq uint64) error {
+	journal.mutex.Lock()
+	defer journal.mutex.Unlock()
+	if journal.file == nil {
+		return errors.New("usage journal is closed")
+	}
+	delete(journal.pending, seq)
+	if err := journal.write(journalEntry{Op: "ack", Seq: seq}); err != nil {
+		return err
+	}
+	journal.acked++
+	if journal.acked >= journalCompactAcks {
+		return journal.compact()
+	}
+	return nil
+}
+
+func (journal *UsageJournal) write(entry journalEntry) error {
+	if journal.broken != nil {
+		return journal.broken
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	if _, err := journal.file.Write(line); err != nil {
+		return journal.rollback(err)
+	}
+	if err := journal.file.Sync(); err != nil {
+		return journal.rollback(err)
+	}
+	journal.size += int64(len(line))
+	return nil
+}
+
+// rollback cuts a failed write off the end of the file, since replay stops at
+// the first torn line and would lose every record appended after it.
+func (journal *UsageJournal) rollback(err error) error {
+	if truncErr := journal.file.Truncate(journal.size); truncErr != nil {
+		journal.broken = errors.New("usage journal is unusable after a failed write: " + truncErr.Error())
+	}
+	return err
+}
+
+// compact rewrites the journal with only the pending records. Callers must
+// hold the mutex.
+func (journal *UsageJournal) compact() error {
+	tmpPath := journal.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+
+	seqs := make([]uint64, 0, len(journal.pending))
+	for seq := range journal.pending {
+		seqs = append(seqs, seq)
+	}
+	slices.Sort(seqs)
+	writer := bufio.NewWriter(tmp)
+	var size int64
+	for _, seq := range seqs {
+		record := journal.pending[seq]
+		line, err := json.Marshal(journalEntry{Op: "add", Seq: seq, Record: &record})
+		if err != nil {
+			tmp.Close()
+			return err
+		}
+		n, _ := writer.Write(append(line, '\n'))
+		size += int64(n)
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpPath, journal.path); err != nil {
+		return errors.New("failed to replace usage journal: " + err.Error())
+	}
+	if err := syncDir(filepath.Dir(journal.path)); err != nil {
+		return errors.New("failed to sync usage journal directory: " + err.Error())
+	}
+
+	file, err := os.OpenFile(journal.path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	journal.file.Close()
+	journal.file = file
+	journal.size = size
+	journal.broken = nil
+	journal.acked = 0
+	return nil
+}
+
+// EnableUsageJournal makes every usage report go through a journal at path
+// before it's considered reported, and replays what an earlier run left there.
+// It must be called before the proxy serves requests.
+func (pro *Proxy) EnableUsageJournal(path string) error {
+	journal, err := OpenUsageJournal(path)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	pro.journal = journal
+	pro.journalStop = cancel
+	pro.journalDone = make(chan struct{})
+	go func() {
+		defer close(pro.journalDone)
+		journal.Run(ctx, pro.reportUsage)
+	}()
+	return nil
+}
+
+// closeJournal waits until ctx is done for the journal to drain, then stops
+// it. Records still in it are delivered after the next start.
+func (pro *Proxy) closeJournal(ctx context.Context) error {
+	waitErr := pro.journal.waitEmpty(ctx)
+	pro.journalStop()
+	<-pro.journalDone
+	return errors.Join(waitErr, pro.journal.Close())
+}
+
+// waitEmpty blocks until every record was delivered or ctx is done.
+func (journal *UsageJournal) waitEmpty(ctx context.Context) error {
+	ticker := time.NewTicker(time.Millisecond * 50)
+	defer ticker.Stop()
+	for {
+		pending := journal.Pending()
+		if pending == 0 {
+			return nil
+		}
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return errors.New(strconv.Itoa(pending) + " usage records left in journal: " + ctx.Err().Error())
+		}
+	}
+}
+
+// syncDir makes a rename inside dir durable. Windows can't sync directories
+// and doesn't need to.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	file, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
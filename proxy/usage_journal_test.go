@@ -0,0 +1,214 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestJournal(t *testing.T, path string) *UsageJournal {
+	t.Helper()
+	journal, err := OpenUsageJournal(path)
+	if err != nil {
+		t.Fatalf("OpenUsageJournal: %v", err)
+	}
+	t.Cleanup(func() { journal.Close() })
+	return journal
+}
+
+func TestUsageJournalAppendAck(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	journal := openTestJournal(t, path)
+
+	for _, uid := range []int64{1, 2, 1} {
+		if err := journal.Append(UsageRecord{UserID: uid, UploadBytes: 10, DownloadBytes: 5}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	if n := journal.Pending(); n != 3 {
+		t.Errorf("Pending = %d, want 3", n)
+	}
+	if n := journal.pendingBytes(1); n != 30 {
+		t.Errorf("pendingBytes(1) = %d, want 30", n)
+	}
+
+	seq, record, found := journal.next()
+	if !found || seq != 1 || record.UserID != 1 || record.ID == "" {
+		t.Fatalf("next = %d %+v %v, want the first record with an ID", seq, record, found)
+	}
+	if err := journal.ack(seq); err != nil {
+		t.Fatalf("ack: %v", err)
+	}
+	if n := journal.pendingBytes(1); n != 15 {
+		t.Errorf("pendingBytes(1) after ack = %d, want 15", n)
+	}
+	if seq, _, _ := journal.next(); seq != 2 {
+		t.Errorf("next after ack = %d, want 2", seq)
+	}
+
+	for _, seq := range []uint64{2, 3} {
+		if err := journal.ack(seq); err != nil {
+			t.Fatalf("ack(%d): %v", seq, err)
+		}
+	}
+	// Acknowledging the last record doesn't compact on its own; the acks stay
+	// on disk until journalCompactAcks of them pile up.
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte{'\n'}); lines != 6 {
+		t.Errorf("journal has %d lines, want 3 adds and 3 acks", lines)
+	}
+	journal.Close()
+
+	journal = openTestJournal(t, path)
+	if n := journal.Pending(); n != 0 {
+		t.Errorf("Pending after reopening = %d, want 0", n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file behind: %v", err)
+	}
+}
+
+func TestUsageJournalCompaction(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	journal := openTestJournal(t, path)
+
+	for range journalCompactAcks + 1 {
+		if err := journal.Append(UsageRecord{UserID: 1, UploadBytes: 1}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	for range journalCompactAcks {
+		seq, _, _ := journal.next()
+		if err := journal.ack(seq); err != nil {
+			t.Fatalf("ack: %v", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := bytes.Count(data, []byte{'\n'}); lines != 1 {
+		t.Errorf("journal has %d lines after compaction, want the one pending record", lines)
+	}
+	if seq, _, _ := journal.next(); seq != journalCompactAcks+1 {
+		t.Errorf("next after compaction = %d, want %d", seq, journalCompactAcks+1)
+	}
+}
+
+func TestUsageJournalRecovery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	journal, err := OpenUsageJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, uid := range []int64{1, 2, 3} {
+		if err := journal.Append(UsageRecord{UserID: uid, DownloadBytes: 100}); err != nil {
+			t.Fatalf("Append: %v", err)
+		}
+	}
+	_, first, _ := journal.next()
+	if err := journal.ack(1); err != nil {
+		t.Fatal(err)
+	}
+	_, second, _ := journal.next()
+	journal.Close()
+
+	// A crash in the middle of a write leaves a torn last line.
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`{"op":"add","seq":4,"record":{"UserID":4,`)
+	file.Close()
+
+	journal = openTestJournal(t, path)
+	if n := journal.Pending(); n != 2 {
+		t.Errorf("Pending after recovery = %d, want 2", n)
+	}
+	seq, record, _ := journal.next()
+	if seq != 2 || record.ID != second.ID || record.ID == first.ID || record.DownloadBytes != 100 {
+		t.Errorf("next after recovery = %d %+v, want record 2 with ID %s", seq, record, second.ID)
+	}
+
+	// The torn record is gone, and appending after it keeps the journal readable.
+	if err := journal.Append(UsageRecord{UserID: 5, UploadBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+	if n := journal.pendingBytes(4); n != 0 {
+		t.Errorf("torn record was recovered with %d bytes", n)
+	}
+	journal.Close()
+
+	journal = openTestJournal(t, path)
+	if n := journal.Pending(); n != 3 {
+		t.Errorf("Pending after second recovery = %d, want 3", n)
+	}
+}
+
+func TestUsageJournalRollback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "usage.journal")
+	journal := openTestJournal(t, path)
+	if err := journal.Append(UsageRecord{UserID: 1, UploadBytes: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	// A write that fails halfway leaves part of a line behind until it's
+	// rolled back.
+	journal.file.WriteString(`{"op":"add","seq":2,`)
+	writeErr := errors.New("no space left on device")
+	if err := journal.rollback(writeErr); err != writeErr {
+		t.Fatalf("rollback = %v, want %v", err, writeErr)
+	}
+	for _, uid := range []int64{2, 3} {
+		if err := journal.Append(UsageRecord{UserID: uid, UploadBytes: 1}); err != nil {
+			t.Fatalf("Append after rollback: %v", err)
+		}
+	}
+	journal.Close()
+
+	journal = openTestJournal(t, path)
+	if n := journal.Pending(); n != 3 {
+		t.Errorf("Pending after reopening = %d, want the 3 records around the failed write", n)
+	}
+}
+
+func TestUsageJournalRun(t *testing.T) {
+	journal := openTestJournal(t, filepath.Join(t.TempDir(), "usage.journal"))
+	for _, uid := range []int64{1, 2, 3} {
+		if err := journal.Append(UsageRecord{UserID: uid}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	delivered := make(chan int64, 3)
+	go journal.Run(ctx, func(ctx context.Context, record UsageRecord) error {
+		delivered <- record.UserID
+		return nil
+	})
+
+	for want := int64(1); want <= 3; want++ {
+		select {
+		case uid := <-delivered:
+			if uid != want {
+				t.Errorf("delivered user %d, want %d", uid, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("journal didn't deliver its records")
+		}
+	}
+	waitCtx, waitCancel := context.WithTimeout(ctx, 5*time.Second)
+	defer waitCancel()
+	if err := journal.waitEmpty(waitCtx); err != nil {
+		t.Errorf("waitEmpty: %v", err)
+	}
+}
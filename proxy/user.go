@@ -1,27 +1,77 @@
 package proxy
 
 import (
+	"cmp"
 	"encoding"
 	"encoding/json"
 	"errors"
 	"io"
 	"math"
 	"net"
+	"slices"
 	"sync"
 	"sync/atomic"
+	"time"
 
-	"goftp.io/server/v2/ratelimit"
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
 )
 
 const connReadSize = 2048
 
+const closeWriteTimeout = time.Second
+
 var _ encoding.TextMarshaler = &User{}
 
+var connSeq atomic.Uint64
+
 type connData struct {
-	time   int64
-	id     int
-	reader io.Reader
-	writer io.Writer
+	time       int64
+	id         int
+	reader     io.Reader
+	writer     *limitedWriter
+	writeMutex *sync.Mutex
+	info       *connInfo
+}
+
+type connInfo struct {
+	seq          uint64
+	network      string
+	destination  string
+	readBytes    atomic.Int64
+	writtenBytes atomic.Int64
+}
+
+// ConnInfo describes a live WebSocket of a user. ReadBytes and WrittenBytes
+// count what went over the WebSocket, framing included.
+type ConnInfo struct {
+	ID           uint64    `json:"id"`
+	RemoteAddr   string    `json:"remote_addr"`
+	Network      string    `json:"network"`
+	Destination  string    `json:"destination,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	ReadBytes    int64     `json:"read_bytes"`
+	WrittenBytes int64     `json:"written_bytes"`
+}
+
+// messageWriter serializes whole WebSocket frames, so control frames sent from
+// other goroutines never interleave with data frames.
+type messageWriter struct {
+	mutex  *sync.Mutex
+	writer *limitedWriter
+}
+
+func (mw messageWriter) WriteMessage(op ws.OpCode, p []byte) error {
+	// Data waits for its tokens before taking the lock, so pongs and close
+	// frames never queue behind a throttled write. Control frames aren't
+	// throttled at all.
+	if !op.IsControl() {
+		mw.writer.limiter.Wait(ws.HeaderSize(ws.Header{Length: int64(len(p))}) + len(p))
+	}
+	mw.mutex.Lock()
+	defer mw.mutex.Unlock()
+	return wsutil.WriteServerMessage(unthrottledWriter{mw.writer}, op, p)
 }
 
 type User struct {
@@ -29,24 +79,50 @@ type User struct {
 	UsedTrafficBytes     atomic.Int64 `json:"used_bytes"`
 	ReportedTrafficBytes atomic.Int64 `json:"reported_traffic_bytes"`
 
+	UploadBytes           atomic.Int64 `json:"upload_bytes"`
+	DownloadBytes         atomic.Int64 `json:"download_bytes"`
+	ReportedUploadBytes   atomic.Int64 `json:"reported_upload_bytes"`
+	ReportedDownloadBytes atomic.Int64 `json:"reported_download_bytes"`
+
 	LastTrafficUpdateTick atomic.Int64
 	Conns                 map[net.Conn]connData
+	muxStreams            map[net.Conn]int
 	Heap                  []byte
-	RateLimit             int64
+	ExpiresAt             time.Time
+	Metadata              map[string]string
 
-	connMutex    sync.Mutex
-	maxConnCount int
-	usedIds      []bool
+	connMutex       sync.Mutex
+	reportMutex     sync.Mutex
+	createdAt       int64
+	maxConnCount    int
+	usedIds         []bool
+	uploadLimiter   *rateLimiter
+	downloadLimiter *rateLimiter
+	authRate        rateLimits
+	rateOverride    *rateLimits
+	destRules       []DestinationRule
+	outboundName    string
+	familyPref      FamilyPreference
+	destinations    *destinationStats
+	metrics         *proxyMetrics
+	hasQuota        atomic.Bool
+	quotaBytes      atomic.Int64
+	quotaBase       atomic.Int64
+	terminated      atomic.Bool
+	expiryTimer     *time.Timer
 }
 
 func NewUser(id int64, usedTrafficBytes int64, maxConnCount int, rateLimit int64) *User {
 	user := &User{
-		ID:           id,
-		Conns:        make(map[net.Conn]connData, maxConnCount),
-		Heap:         make([]byte, connReadSize*2*maxConnCount),
-		RateLimit:    rateLimit,
-		usedIds:      make([]bool, maxConnCount),
-		maxConnCount: maxConnCount,
+		ID:              id,
+		Conns:           make(map[net.Conn]connData, maxConnCount),
+		muxStreams:      map[net.Conn]int{},
+		Heap:            make([]byte, connReadSize*2*maxConnCount),
+		uploadLimiter:   newRateLimiter(rateLimit, 0),
+		downloadLimiter: newRateLimiter(rateLimit, 0),
+		usedIds:         make([]bool, maxConnCount),
+		maxConnCount:    maxConnCount,
+		createdAt:       nowns(),
 	}
 	user.UsedTrafficBytes.Store(usedTrafficBytes)
 	user.ReportedTrafficBytes.Store(0)
@@ -94,6 +170,47 @@ func (user *User) ConnWriter(conn net.Conn) (io.Writer, error) {
 	return nil, errors.New("connection doesn't exist")
 }
 
+func (user *User) messageWriter(conn net.Conn) (messageWriter, error) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if d, found := user.Conns[conn]; found {
+		return messageWriter{mutex: d.writeMutex, writer: d.writer}, nil
+	}
+	return messageWriter{}, errors.New("connection doesn't exist")
+}
+
+// connLoad is what counts against the connection limit: every WebSocket and
+// every mux stream but the first of each session, which rides on its
+// WebSocket.
+func (user *User) connLoad() int {
+	load := len(user.Conns)
+	for _, n := range user.muxStreams {
+		load += max(n-1, 0)
+	}
+	return load
+}
+
+// openStream counts a new mux stream of the WebSocket conn against the
+// connection limit. Streams beyond the limit are refused rather than evicting
+// anything.
+func (user *User) openStream(conn net.Conn) bool {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if user.muxStreams[conn] > 0 && user.connLoad() >= user.maxConnCount {
+		return false
+	}
+	user.muxStreams[conn]++
+	return true
+}
+
+func (user *User) closeStream(conn net.Conn) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if user.muxStreams[conn]--; user.muxStreams[conn] <= 0 {
+		delete(user.muxStreams, conn)
+	}
+}
+
 func (user *User) ConnCount() int {
 	user.connMutex.Lock()
 	defer user.connMutex.Unlock()
@@ -108,7 +225,7 @@ func (user *User) AddConn(conn net.Conn) (net.Conn, error) {
 	}
 	var selectedConn net.Conn = nil
 	selectedConnId := 0
-	if len(user.Conns) >= user.maxConnCount {
+	if user.connLoad() >= user.maxConnCount {
 		minTime := int64(math.MaxInt64)
 		for c, d := range user.Conns {
 			if d.time < minTime {
@@ -118,10 +235,11 @@ func (user *User) AddConn(conn net.Conn) (net.Conn, error) {
 			}
 		}
 		if selectedConn != nil {
+			closeConn(selectedConn, user.Conns[selectedConn], closeFrameBody(protocol.CloseEvicted, protocol.CloseEvicted.String()))
 			delete(user.Conns, selectedConn)
 		}
 	} else {
-		for i := 0; i < user.maxConnCount; i++ {
+		for i := 0; i < len(user.usedIds); i++ {
 			if !user.usedIds[i] {
 				selectedConnId = i
 				user.usedIds[i] = true
@@ -129,15 +247,65 @@ func (user *User) AddConn(conn net.Conn) (net.Conn, error) {
 			}
 		}
 	}
+	info := &connInfo{seq: connSeq.Add(1)}
 	user.Conns[conn] = connData{
 		time:   nowns(),
 		id:     selectedConnId,
-		reader: ratelimit.Reader(conn, ratelimit.New(user.RateLimit)),
-		writer: ratelimit.Writer(conn, ratelimit.New(user.RateLimit)),
+		reader: &limitedReader{reader: conn, limiter: user.uploadLimiter, count: &info.readBytes},
+		writer: &limitedWriter{writer: conn, limiter: user.downloadLimiter, count: &info.writtenBytes},
+
+		writeMutex: &sync.Mutex{},
+		info:       info,
 	}
 	return selectedConn, nil
 }
 
+// describeConn records what a connection carries for ConnInfos.
+func (user *User) describeConn(conn net.Conn, network string, destination string) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if d, found := user.Conns[conn]; found {
+		d.info.network = network
+		d.info.destination = destination
+	}
+}
+
+func (user *User) ConnInfos() []ConnInfo {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	infos := make([]ConnInfo, 0, len(user.Conns))
+	for conn, d := range user.Conns {
+		infos = append(infos, ConnInfo{
+			ID:           d.info.seq,
+			RemoteAddr:   conn.RemoteAddr().String(),
+			Network:      d.info.network,
+			Destination:  d.info.destination,
+			StartedAt:    time.Unix(0, d.time),
+			ReadBytes:    d.info.readBytes.Load(),
+			WrittenBytes: d.info.writtenBytes.Load(),
+		})
+	}
+	slices.SortFunc(infos, func(a, b ConnInfo) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	return infos
+}
+
+// CloseConn sends a close frame to the connection with the given ConnInfo ID
+// and closes it.
+func (user *User) CloseConn(id uint64, code ws.StatusCode, reason string) error {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	for conn, d := range user.Conns {
+		if d.info.seq != id {
+			continue
+		}
+		closeConn(conn, d, ws.NewCloseFrameBody(code, reason))
+		return nil
+	}
+	return errors.New("connection doesn't exist")
+}
+
 func (user *User) RemoveConn(conn net.Conn) error {
 	user.connMutex.Lock()
 	defer user.connMutex.Unlock()
@@ -149,9 +317,223 @@ func (user *User) RemoveConn(conn net.Conn) error {
 	return errors.New("connection doesn't exist")
 }
 
+func (user *User) ApplyAuthResult(result *AuthResult) {
+	user.applyAuthResult(result, 0)
+}
+
+// applyAuthResult takes result.RemainingBytes as the quota left after the
+// traffic the authenticator has confirmed. unacked is what it was sent but
+// hasn't confirmed yet, possibly by an earlier User of the same ID, which
+// still counts against the quota.
+func (user *User) applyAuthResult(result *AuthResult, unacked int64) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	user.ExpiresAt = result.ExpiresAt
+	user.Metadata = result.Metadata
+	user.destRules = result.DestinationRules
+	user.outboundName = result.Outbound
+	user.familyPref = result.FamilyPreference
+	user.hasQuota.Store(result.HasQuota)
+	user.quotaBytes.Store(result.RemainingBytes)
+	user.quotaBase.Store(user.ReportedTrafficBytes.Load() - unacked)
+	user.terminated.Store(false)
+
+	if user.expiryTimer != nil {
+		user.expiryTimer.Stop()
+		user.expiryTimer = nil
+	}
+	if !result.ExpiresAt.IsZero() {
+		user.expiryTimer = time.AfterFunc(time.Until(result.ExpiresAt), func() {
+			user.Terminate(ws.StatusPolicyViolation, "account expired")
+		})
+	}
+}
+
+func (user *User) DestinationRules() []DestinationRule {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	return user.destRules
+}
+
+func (user *User) OutboundName() string {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	return user.outboundName
+}
+
+func (user *User) FamilyPreference() FamilyPreference {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	return user.familyPref
+}
+
+// enableDestinationStats starts the per-destination breakdown, keeping the
+// topN busiest destinations per reporting window.
+func (user *User) enableDestinationStats(topN int) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if user.destinations == nil {
+		user.destinations = newDestinationStats(topN)
+	}
+}
+
+func (user *User) destinationStats() *destinationStats {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	return user.destinations
+}
+
+// SetRateLimit changes the bandwidth shared by all of the user's connections,
+// including the ones already open.
+func (user *User) SetRateLimit(upload int64, download int64, burst int64) {
+	user.uploadLimiter.SetRate(upload, burst)
+	user.downloadLimiter.SetRate(download, burst)
+}
+
+type rateLimits struct {
+	upload   int64
+	download int64
+	burst    int64
+}
+
+// setAuthRateLimit applies the limits the authenticator answered with, unless
+// an administrator has overridden them.
+func (user *User) setAuthRateLimit(upload int64, download int64, burst int64) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	user.authRate = rateLimits{upload, download, burst}
+	if user.rateOverride == nil {
+		user.SetRateLimit(upload, download, burst)
+	}
+}
+
+// OverrideRateLimit is SetRateLimit that survives re-authentication, until
+// ClearRateLimitOverride.
+func (user *User) OverrideRateLimit(upload int64, download int64, burst int64) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	user.rateOverride = &rateLimits{upload, download, burst}
+	user.SetRateLimit(upload, download, burst)
+}
+
+// ClearRateLimitOverride goes back to the limits of the last authentication.
+func (user *User) ClearRateLimitOverride() {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	user.rateOverride = nil
+	user.SetRateLimit(user.authRate.upload, user.authRate.download, user.authRate.burst)
+}
+
+func (user *User) RateLimitOverridden() bool {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	return user.rateOverride != nil
+}
+
+// RateLimit returns the upload rate limit in bytes per second.
+//
+// Deprecated: RateLimit used to be a field applying to both directions; use
+// RateLimits.
+func (user *User) RateLimit() int64 {
+	upload, _ := user.uploadLimiter.Rate()
+	return upload
+}
+
+func (user *User) RateLimits() (upload int64, download int64, burst int64) {
+	upload, burst = user.uploadLimiter.Rate()
+	download, _ = user.downloadLimiter.Rate()
+	return upload, download, burst
+}
+
+func (user *User) SetMaxConns(maxConnCount int) {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if maxConnCount > len(user.usedIds) {
+		user.usedIds = append(user.usedIds, make([]bool, maxConnCount-len(user.usedIds))...)
+		heap := make([]byte, connReadSize*2*maxConnCount)
+		copy(heap, user.Heap)
+		user.Heap = heap
+	}
+	user.maxConnCount = maxConnCount
+}
+
+// RemainingBytes reports how much traffic the user may still use, counting
+// bytes not yet reported to the authenticator. ok is false when the user has
+// no quota.
+func (user *User) RemainingBytes() (remaining int64, ok bool) {
+	if !user.hasQuota.Load() {
+		return 0, false
+	}
+	return user.quotaBytes.Load() - (user.UsedTrafficBytes.Load() - user.quotaBase.Load()), true
+}
+
+func (user *User) AddUpload(n int64) {
+	user.UploadBytes.Add(n)
+	if user.metrics != nil {
+		user.metrics.uploadBytes.Add(n)
+	}
+	user.addTraffic(n)
+}
+
+func (user *User) AddDownload(n int64) {
+	user.DownloadBytes.Add(n)
+	if user.metrics != nil {
+		user.metrics.downloadBytes.Add(n)
+	}
+	user.addTraffic(n)
+}
+
+// addTraffic accounts n bytes to the user's total and drops every connection
+// of the user once the quota granted by the authenticator runs out.
+func (user *User) addTraffic(n int64) {
+	user.UsedTrafficBytes.Add(n)
+	if remaining, ok := user.RemainingBytes(); ok && remaining <= 0 {
+		user.Terminate(ws.StatusCode(protocol.CloseQuotaExceeded), "traffic quota exceeded")
+	}
+}
+
+// Terminate sends a close frame with the given code and reason to every
+// connection of the user and closes them.
+func (user *User) Terminate(code ws.StatusCode, reason string) {
+	if !user.terminated.CompareAndSwap(false, true) {
+		return
+	}
+
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	body := ws.NewCloseFrameBody(code, reason)
+	for conn, d := range user.Conns {
+		closeConn(conn, d, body)
+	}
+}
+
+// closeConn sends the close frame body to conn and closes it without
+// blocking the caller, who may hold connMutex.
+func closeConn(conn net.Conn, d connData, body []byte) {
+	mw := messageWriter{mutex: d.writeMutex, writer: d.writer}
+	go func() {
+		conn.SetWriteDeadline(time.Now().Add(closeWriteTimeout))
+		mw.WriteMessage(ws.OpClose, body)
+		conn.Close()
+	}()
+}
+
+func (user *User) stopExpiryTimer() {
+	user.connMutex.Lock()
+	defer user.connMutex.Unlock()
+	if user.expiryTimer != nil {
+		user.expiryTimer.Stop()
+		user.expiryTimer = nil
+	}
+}
+
 func (user *User) Cleanup() {
 	user.connMutex.Lock()
 	defer user.connMutex.Unlock()
+	if user.expiryTimer != nil {
+		user.expiryTimer.Stop()
+		user.expiryTimer = nil
+	}
 	for conn := range user.Conns {
 		conn.Close()
 	}
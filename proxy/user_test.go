@@ -0,0 +1,37 @@
+package proxy
+
+import "testing"
+
+func TestUserQuota(t *testing.T) {
+	tests := []struct {
+		name       string
+		result     AuthResult
+		used       int64
+		remaining  int64
+		limited    bool
+		terminated bool
+	}{
+		{"no quota", AuthResult{}, 100, 0, false, false},
+		{"no quota ignores RemainingBytes", AuthResult{RemainingBytes: -5}, 100, 0, false, false},
+		{"within quota", AuthResult{HasQuota: true, RemainingBytes: 1000}, 100, 900, true, false},
+		{"quota used up", AuthResult{HasQuota: true, RemainingBytes: 1000}, 1000, 0, true, true},
+		{"zero allowance", AuthResult{HasQuota: true}, 0, 0, true, false},
+		{"negative allowance", AuthResult{HasQuota: true, RemainingBytes: -5}, 0, -5, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			user := NewUser(1, 0, 1, 0)
+			user.ApplyAuthResult(&test.result)
+			if test.used > 0 {
+				user.AddUpload(test.used)
+			}
+			remaining, limited := user.RemainingBytes()
+			if remaining != test.remaining || limited != test.limited {
+				t.Errorf("RemainingBytes = %d, %v, want %d, %v", remaining, limited, test.remaining, test.limited)
+			}
+			if terminated := user.terminated.Load(); terminated != test.terminated {
+				t.Errorf("terminated = %v, want %v", terminated, test.terminated)
+			}
+		})
+	}
+}
@@ -2,7 +2,10 @@ package proxy
 
 import (
 	"context"
+	"errors"
 	"net"
+	"net/netip"
+	"slices"
 	"strconv"
 	"time"
 
@@ -10,75 +13,104 @@ import (
 )
 
 type endpointAddr struct {
-	ip   net.IP
-	port uint16
-	zone string
+	host  string
+	addrs []netip.Addr
+	port  uint16
+}
+
+func (addr *endpointAddr) addrPort() netip.AddrPort {
+	return netip.AddrPortFrom(addr.addrs[0], addr.port)
+}
+
+func (addr *endpointAddr) addrPorts() []netip.AddrPort {
+	addrPorts := make([]netip.AddrPort, len(addr.addrs))
+	for i, ip := range addr.addrs {
+		addrPorts[i] = netip.AddrPortFrom(ip, addr.port)
+	}
+	return addrPorts
+}
+
+// String returns the endpoint as the client asked for it.
+func (addr *endpointAddr) String() string {
+	return net.JoinHostPort(addr.host, strconv.Itoa(int(addr.port)))
+}
+
+// packetDestination names a UDP peer, using the endpoint's own name when the
+// packet goes to one of its addresses.
+func (addr *endpointAddr) packetDestination(addrPort netip.AddrPort) string {
+	addrPort = netip.AddrPortFrom(addrPort.Addr().Unmap(), addrPort.Port())
+	if addrPort.Port() == addr.port && slices.Contains(addr.addrs, addrPort.Addr()) {
+		return addr.String()
+	}
+	return addrPort.String()
 }
 
 func nowns() int64 {
 	return time.Now().UnixNano()
 }
 
-func parseEndpointAddr(ctx context.Context, resolver *net.Resolver, endpoint string) (*endpointAddr, error) {
+// resolveError marks endpoints whose host couldn't be resolved, as opposed to
+// malformed ones.
+type resolveError struct {
+	err error
+}
+
+func (err *resolveError) Error() string {
+	return err.err.Error()
+}
+
+func (err *resolveError) Unwrap() error {
+	return err.err
+}
+
+// parseEndpointAddr resolves endpoint and keeps every address allowed by
+// check, ordered by the family preference.
+func parseEndpointAddr(ctx context.Context, resolver Resolver, endpoint string, family FamilyPreference, check func(host string, addr netip.AddrPort) error) (*endpointAddr, error) {
 	host, portStr, err := net.SplitHostPort(endpoint)
 	if err != nil {
 		return nil, err
 	}
 
-	ips, err := resolver.LookupIPAddr(ctx, host)
+	port, err := strconv.ParseUint(portStr, 10, 16)
 	if err != nil {
-		return nil, err
+		return nil, errors.New("invalid port: " + portStr)
 	}
 
-	port, _ := strconv.Atoi(portStr)
+	var addrs []netip.Addr
+	if addr, err := netip.ParseAddr(host); err == nil {
+		addrs = []netip.Addr{addr}
+	} else if addrs, _, err = resolver.LookupAddrs(ctx, host); err != nil {
+		return nil, &resolveError{err: err}
+	}
+	addrs = sortAddrs(addrs, family)
+	if len(addrs) == 0 {
+		return nil, &resolveError{err: errors.New("no usable address found for " + host)}
+	}
+
+	// The policy sees the resolved addresses and the caller dials only the
+	// ones returned here, so a rebinding DNS answer can't slip past the check.
+	var checkErr error
+	allowed := addrs[:0]
+	for _, addr := range addrs {
+		if err := check(host, netip.AddrPortFrom(addr, uint16(port))); err != nil {
+			if checkErr == nil {
+				checkErr = err
+			}
+			continue
+		}
+		allowed = append(allowed, addr)
+	}
+	if len(allowed) == 0 {
+		return nil, checkErr
+	}
 
 	return &endpointAddr{
-		ip:   ips[0].IP,
-		port: uint16(port),
-		zone: ips[0].Zone,
+		host:  host,
+		addrs: allowed,
+		port:  uint16(port),
 	}, nil
 }
 
-// func parseEndpointTCP(ctx context.Context, resolver *net.Resolver, endpoint string) (*net.TCPAddr, error) {
-// 	host, portStr, err := net.SplitHostPort(endpoint)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	ips, err := resolver.LookupIPAddr(ctx, host)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	port, _ := strconv.Atoi(portStr)
-
-// 	return &net.TCPAddr{
-// 		IP:   ips[0].IP,
-// 		Port: port,
-// 		Zone: ips[0].Zone,
-// 	}, nil
-// }
-
-// func parseEndpointUDP(ctx context.Context, resolver *net.Resolver, endpoint string) (*net.UDPAddr, error) {
-// 	host, portStr, err := net.SplitHostPort(endpoint)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	ips, err := resolver.LookupIPAddr(ctx, host)
-// 	if err != nil {
-// 		return nil, err
-// 	}
-
-// 	port, _ := strconv.Atoi(portStr)
-
-// 	return &net.UDPAddr{
-// 		IP:   ips[0].IP,
-// 		Port: port,
-// 		Zone: ips[0].Zone,
-// 	}, nil
-// }
-
 func isTimeoutErr(err error) bool {
 	if nErr, ok := ge.As[net.Error](err); ok && nErr.Timeout() {
 		return true
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/b00tkitism/wsc/protocol"
+	"github.com/gobwas/ws"
+)
+
+// supportedCapabilities is what the proxy grants when a client asks.
+const supportedCapabilities = protocol.CapMux | protocol.CapUDPDomain | protocol.CapHalfClose
+
+// handshake is the outcome of the version negotiation of a tunnel.
+type handshake struct {
+	version      int
+	capabilities protocol.Capabilities
+	subprotocol  string
+}
+
+// negotiate picks the protocol version and capabilities for a request. A
+// version subprotocol wins over the v query parameter, and the first
+// subprotocol the proxy speaks is the one selected, as in RFC 6455.
+func negotiate(request *http.Request) handshake {
+	hs := handshake{}
+	offered := 0
+	for _, value := range request.Header.Values("Sec-WebSocket-Protocol") {
+		for _, p := range strings.Split(value, ",") {
+			p = strings.TrimSpace(p)
+			if version, ok := protocol.ParseVersionSubprotocol(p); ok && version <= protocol.LatestVersion {
+				hs.subprotocol, offered = p, version
+				break
+			}
+			if p == protocol.Subprotocol {
+				hs.subprotocol = p
+				break
+			}
+		}
+		if hs.subprotocol != "" {
+			break
+		}
+	}
+
+	query := request.URL.Query()
+	if offered == 0 {
+		offered, _ = strconv.Atoi(query.Get(protocol.VersionQueryParam))
+	}
+	hs.version = protocol.NegotiateVersion(offered)
+	hs.capabilities = protocol.ParseCapabilities(query.Get(protocol.CapabilitiesQueryParam)) & supportedCapabilities
+	if hs.version < protocol.Version2 {
+		hs.capabilities &^= protocol.CapUDPDomain
+	}
+	return hs
+}
+
+// upgrader selects the negotiated subprotocol and announces the version.
+func (hs handshake) upgrader() ws.HTTPUpgrader {
+	header := http.Header{protocol.VersionHeader: {strconv.Itoa(hs.version)}}
+	if hs.capabilities != 0 {
+		header.Set(protocol.CapabilitiesHeader, hs.capabilities.String())
+	}
+	return ws.HTTPUpgrader{
+		Protocol: func(p string) bool {
+			return p == hs.subprotocol
+		},
+		Header: header,
+	}
+}